@@ -0,0 +1,126 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const AFTER_UPLOAD_NONE string = ""
+const AFTER_UPLOAD_S3 string = "s3"
+const AFTER_UPLOAD_MOVE string = "move"
+
+// What to do when a replay being moved to ArchiveDir has the same name as one already there.
+const MOVE_COLLISION_RENAME string = "rename"
+const MOVE_COLLISION_SKIP string = "skip"
+const MOVE_COLLISION_OVERWRITE string = "overwrite"
+
+const CREATE_ARCHIVED_REPLAYS_SQL string = `CREATE TABLE IF NOT EXISTS archived_replays(
+	replay_file_name varchar(512) NOT NULL,
+	object_key text NOT NULL,
+	archived_at integer NOT NULL
+);`
+
+// runAfterUpload does whatever the configured AfterUpload mode calls for with a replay that has just
+// been posted. Failures are logged rather than returned so they never hold up posting other replays.
+func runAfterUpload(replayFilePath string, replayName string, db *sql.DB, config *Config) {
+	switch config.AfterUpload {
+	case AFTER_UPLOAD_S3:
+		objectKey, err := archiveReplayToS3(replayFilePath, config)
+		if err != nil {
+			logErrorf("Error archiving replay '%s' to S3: %s", replayFilePath, err)
+			return
+		}
+		logInfof("Archived replay '%s' to s3://%s/%s", replayFilePath, config.S3Bucket, objectKey)
+
+		if err := recordReplayWasArchived(replayName, objectKey, db); err != nil {
+			logErrorf("%s", err)
+		}
+
+		if config.S3DeleteAfterArchive {
+			if err := os.Remove(replayFilePath); err != nil {
+				logErrorf("Error deleting archived replay '%s': %s", replayFilePath, err)
+			} else {
+				logInfof("Deleted archived replay '%s'", replayFilePath)
+			}
+		}
+	case AFTER_UPLOAD_MOVE:
+		archivePath, err := archiveReplayToDir(replayFilePath, config)
+		if err != nil {
+			logErrorf("Error moving replay '%s' to the archive directory: %s", replayFilePath, err)
+			return
+		} else if archivePath == "" {
+			return
+		}
+		logInfof("Archived replay '%s' to '%s'", replayFilePath, archivePath)
+
+		if err := recordReplayWasArchived(replayName, archivePath, db); err != nil {
+			logErrorf("%s", err)
+		}
+	}
+}
+
+// archiveReplayToDir moves a replay into ArchiveDir and returns its new path. If that would leave less
+// than ArchiveMinFreeMB free on the archive volume, or a replay of the same name is already archived and
+// MoveCollisionStrategy is "skip", the replay is left in place and the returned path is empty.
+func archiveReplayToDir(replayFilePath string, config *Config) (string, error) {
+	if err := os.MkdirAll(config.ArchiveDir, 0755); err != nil {
+		return "", err
+	}
+
+	if config.ArchiveMinFreeMB > 0 {
+		if info, err := os.Stat(replayFilePath); err != nil {
+			return "", err
+		} else if free, err := freeDiskBytes(config.ArchiveDir); err != nil {
+			logWarnf("can't check the free space in archive directory '%s', moving replay '%s' anyway: %s", config.ArchiveDir, replayFilePath, err)
+		} else if minFree := uint64(config.ArchiveMinFreeMB) * 1024 * 1024; free < minFree+uint64(info.Size()) {
+			logWarnf("archive directory '%s' has only %d MB free, leaving replay '%s' in place", config.ArchiveDir, free/1024/1024, replayFilePath)
+			return "", nil
+		}
+	}
+
+	archivePath := archiveCollisionPath(filepath.Join(config.ArchiveDir, filepath.Base(replayFilePath)), config)
+	if archivePath == "" {
+		logWarnf("a replay named '%s' is already in archive directory '%s', leaving replay '%s' in place", filepath.Base(replayFilePath), config.ArchiveDir, replayFilePath)
+		return "", nil
+	}
+
+	if err := moveFile(replayFilePath, archivePath); err != nil {
+		return "", err
+	}
+
+	return archivePath, nil
+}
+
+// archiveCollisionPath returns the path to move a replay to when archivePath, in ArchiveDir or
+// DeadLetterDir, may already be taken: the first free "<name>-<n><ext>" with MoveCollisionStrategy
+// "rename", an empty path to skip the replay with "skip", or archivePath itself with "overwrite".
+func archiveCollisionPath(archivePath string, config *Config) string {
+	if !fileExists(archivePath) || config.MoveCollisionStrategy == MOVE_COLLISION_OVERWRITE {
+		return archivePath
+	} else if config.MoveCollisionStrategy == MOVE_COLLISION_SKIP {
+		return ""
+	}
+
+	ext := filepath.Ext(archivePath)
+	base := strings.TrimSuffix(archivePath, ext)
+	for n := 1; ; n++ {
+		if candidate := fmt.Sprintf("%s-%d%s", base, n, ext); !fileExists(candidate) {
+			return candidate
+		}
+	}
+}
+
+func recordReplayWasArchived(replayFileName string, objectKey string, db *sql.DB) error {
+	_, err := db.Exec("INSERT INTO archived_replays(replay_file_name, object_key, archived_at) VALUES(?, ?, ?);",
+		replayFileName, objectKey, time.Now().Unix())
+	if err != nil {
+		return errors.New(fmt.Sprintf("Error recording that replay '%s' was archived as '%s': %s", replayFileName, objectKey, err))
+	}
+
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+const AUDIT_EVENT_UPLOADED string = "uploaded"
+const AUDIT_EVENT_SKIPPED string = "skipped"
+const AUDIT_EVENT_FAILED string = "failed"
+
+// AuditEvent is one line of the AuditLogPath file.
+type AuditEvent struct {
+	Time    time.Time `json:"time"`
+	Event   string    `json:"event"`
+	Replay  string    `json:"replay"`
+	Target  string    `json:"target"`
+	Channel string    `json:"channel"`
+	FileId  string    `json:"file_id,omitempty"`
+	Reason  string    `json:"reason,omitempty"`
+}
+
+var auditLogMutex sync.Mutex
+
+// writeAuditEvent appends an event about a replay to AuditLogPath as a line of JSON, if it's set. The
+// file is opened for each event so that it can be rotated or removed while the uploader is running.
+func writeAuditEvent(event string, replayName string, fileId string, reason string, config *Config) {
+	if config.AuditLogPath == "" {
+		return
+	}
+
+	line, err := json.Marshal(AuditEvent{
+		Time:    time.Now().UTC(),
+		Event:   event,
+		Replay:  replayName,
+		Target:  config.Target,
+		Channel: config.ChannelID,
+		FileId:  fileId,
+		Reason:  reason,
+	})
+	if err != nil {
+		logErrorf("Error encoding audit event for replay '%s': %s", replayName, err)
+		return
+	}
+
+	auditLogMutex.Lock()
+	defer auditLogMutex.Unlock()
+
+	fh, err := os.OpenFile(config.AuditLogPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		logErrorf("Error opening AuditLogPath '%s': %s", config.AuditLogPath, err)
+		return
+	}
+	defer fh.Close()
+
+	if _, err := fh.Write(append(line, '\n')); err != nil {
+		logErrorf("Error writing to AuditLogPath '%s': %s", config.AuditLogPath, err)
+	}
+}
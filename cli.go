@@ -0,0 +1,247 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Subcommand is one of the uploader's commands, e.g. "list". run gets the arguments after the
+// subcommand's name and returns the code to exit with.
+type Subcommand struct {
+	name    string
+	usage   string
+	summary string
+	run     func(args []string, out io.Writer) int
+}
+
+func subcommands() []Subcommand {
+	return []Subcommand{
+		{"watch", "[-once]", "post new replays as they turn up (the default)", runWatch},
+		{"list", "[-all]", "list the replays in the upload queue that haven't been posted", runList},
+		{"requeue", "<replay>", "retry a replay that failed to upload or was dead-lettered on the next scan", runRequeue},
+		{"check-config", "[-check-auth]", "validate the configuration without uploading anything", runCheckConfig},
+		{"version", "", "print the version", runVersion},
+	}
+}
+
+// runCommand runs the subcommand named by args[0]. Without one, it runs "watch", still accepting the
+// -once, -check-config, -check-auth and -version flags of versions that had no subcommands.
+func runCommand(args []string, out io.Writer) int {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return runLegacyFlags(args, out)
+	}
+
+	for _, subcommand := range subcommands() {
+		if subcommand.name == args[0] {
+			return subcommand.run(args[1:], out)
+		}
+	}
+
+	fmt.Fprintf(out, "Unknown command '%s'\n\n", args[0])
+	printUsage(out)
+	return EXIT_CODE_CONFIG
+}
+
+func printUsage(out io.Writer) {
+	fmt.Fprintf(out, "Usage: towerfall_replay_slack_uploader [command] [flags]\n\nCommands:\n")
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	for _, subcommand := range subcommands() {
+		fmt.Fprintf(w, "  %s %s\t%s\n", subcommand.name, subcommand.usage, subcommand.summary)
+	}
+	w.Flush()
+	fmt.Fprintf(out, "\nRun a command with -h for its flags.\n")
+}
+
+func newFlagSet(name string, usage string, out io.Writer) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(out)
+	flags.Usage = func() {
+		fmt.Fprintf(out, "Usage: towerfall_replay_slack_uploader %s %s\n", name, usage)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// parseFlags parses a subcommand's flags, returning false with the code to exit with if it shouldn't run.
+func parseFlags(flags *flag.FlagSet, args []string) (bool, int) {
+	if err := flags.Parse(args); err == flag.ErrHelp {
+		return false, 0
+	} else if err != nil {
+		return false, EXIT_CODE_CONFIG
+	}
+
+	return true, 0
+}
+
+func runLegacyFlags(args []string, out io.Writer) int {
+	flags := newFlagSet("", "[flags]", out)
+	flags.Usage = func() {
+		printUsage(out)
+		fmt.Fprintf(out, "\nFlags without a command, for compatibility:\n")
+		flags.PrintDefaults()
+	}
+	once := flags.Bool("once", false, "same as watch -once")
+	checkConfig := flags.Bool("check-config", false, "same as check-config")
+	checkAuth := flags.Bool("check-auth", false, "same as check-config -check-auth")
+	printVersion := flags.Bool("version", false, "same as version")
+	if ok, code := parseFlags(flags, args); !ok {
+		return code
+	}
+
+	if *printVersion {
+		return runVersion(nil, out)
+	} else if *checkConfig {
+		return checkConfigAndExitCode(CONF_PATH, *checkAuth, out)
+	}
+
+	return watch(CONF_PATH, *once)
+}
+
+func runWatch(args []string, out io.Writer) int {
+	flags := newFlagSet("watch", "[-once]", out)
+	once := flags.Bool("once", false, "scan the replay directory a single time and exit instead of watching it")
+	if ok, code := parseFlags(flags, args); !ok {
+		return code
+	}
+
+	return watch(CONF_PATH, *once)
+}
+
+func runCheckConfig(args []string, out io.Writer) int {
+	flags := newFlagSet("check-config", "[-check-auth]", out)
+	checkAuth := flags.Bool("check-auth", false, "also check the configured credentials with the target")
+	if ok, code := parseFlags(flags, args); !ok {
+		return code
+	}
+
+	return checkConfigAndExitCode(CONF_PATH, *checkAuth, out)
+}
+
+func runVersion(args []string, out io.Writer) int {
+	fmt.Fprintf(out, "towerfall_replay_slack_uploader %s\n", versionString())
+	return 0
+}
+
+func runList(args []string, out io.Writer) int {
+	flags := newFlagSet("list", "[-all]", out)
+	all := flags.Bool("all", false, "also list the replays that were posted")
+	if ok, code := parseFlags(flags, args); !ok {
+		return code
+	}
+
+	return withQueueDb(CONF_PATH, out, func(db *sql.DB, config *Config) error {
+		return listQueuedReplays(db, *all, out)
+	})
+}
+
+func runRequeue(args []string, out io.Writer) int {
+	flags := newFlagSet("requeue", "<replay>", out)
+	if ok, code := parseFlags(flags, args); !ok {
+		return code
+	} else if flags.NArg() != 1 {
+		flags.Usage()
+		return EXIT_CODE_CONFIG
+	}
+
+	return withQueueDb(CONF_PATH, out, func(db *sql.DB, config *Config) error {
+		return requeueReplay(filepath.Base(flags.Arg(0)), db, config, out)
+	})
+}
+
+// withQueueDb reads the configuration and opens its database for a subcommand that works on the upload
+// queue, returning the code to exit with.
+func withQueueDb(confPath string, out io.Writer, run func(db *sql.DB, config *Config) error) int {
+	config, err := readConfig(confPath)
+	if err != nil {
+		fmt.Fprintf(out, "Error reading the configuration at '%s': %s\n", confPath, err)
+		return exitCode(err)
+	}
+
+	if err := initializeDbIfNotExist(config.DatabasePath, config); err != nil {
+		fmt.Fprintf(out, "Error initializing the database at '%s': %s\n", config.DatabasePath, err)
+		return EXIT_CODE_DATABASE
+	}
+	db, err := openDb(config.DatabasePath, config)
+	if err != nil {
+		fmt.Fprintf(out, "Error opening the database at '%s': %s\n", config.DatabasePath, err)
+		return EXIT_CODE_DATABASE
+	}
+	defer db.Close()
+
+	if err := run(db, config); err != nil {
+		fmt.Fprintf(out, "%s\n", err)
+		return exitCode(err)
+	}
+
+	return 0
+}
+
+func listQueuedReplays(db *sql.DB, all bool, out io.Writer) error {
+	query := "SELECT replay_file_name, status, attempts, COALESCE(last_error, ''), updated_at FROM upload_queue"
+	if !all {
+		query += fmt.Sprintf(" WHERE status != '%s'", QUEUE_STATUS_DONE)
+	}
+
+	rows, err := db.Query(query + " ORDER BY discovered_at, replay_file_name;")
+	if err != nil {
+		return &DatabaseError{err}
+	}
+	defer rows.Close()
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "REPLAY\tSTATUS\tATTEMPTS\tUPDATED\tLAST ERROR\n")
+	for rows.Next() {
+		var replayName, status, lastError string
+		var attempts int
+		var updatedAt int64
+		if err := rows.Scan(&replayName, &status, &attempts, &lastError, &updatedAt); err != nil {
+			return &DatabaseError{err}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n", replayName, status, attempts, time.Unix(updatedAt, 0).Format("2006-01-02 15:04:05"), lastError)
+	}
+	if err := rows.Err(); err != nil {
+		return &DatabaseError{err}
+	}
+
+	return w.Flush()
+}
+
+// requeueReplay marks a replay that failed to upload, or was dead-lettered or denied, as pending with no
+// attempts, moving it back from DeadLetterDir if it's there, so the next scan posts it.
+func requeueReplay(replayName string, db *sql.DB, config *Config, out io.Writer) error {
+	status, err := replayQueueStatus(replayName, db)
+	if err != nil {
+		return &DatabaseError{err}
+	}
+
+	switch status {
+	case "":
+		return errors.New(fmt.Sprintf("Replay '%s' isn't in the upload queue", replayName))
+	case QUEUE_STATUS_DONE, QUEUE_STATUS_PENDING:
+		return errors.New(fmt.Sprintf("Replay '%s' is already %s, there's nothing to requeue", replayName, status))
+	}
+
+	replayFilePath := failedReplayPath(replayName, config)
+	if replayFilePath == "" {
+		return errors.New(fmt.Sprintf("Replay '%s' is in neither ReplayDirectoryPath nor DeadLetterDir", replayName))
+	} else if filepath.Dir(replayFilePath) != filepath.Clean(config.ReplayDirectoryPath) {
+		if err := moveFile(replayFilePath, filepath.Join(config.ReplayDirectoryPath, replayName)); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Moved replay '%s' back from '%s'\n", replayName, config.DeadLetterDir)
+	}
+
+	if err := markReplayPending(replayName, db); err != nil {
+		return &DatabaseError{err}
+	}
+
+	fmt.Fprintf(out, "Requeued replay '%s', it will be posted on the next scan\n", replayName)
+	return nil
+}
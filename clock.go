@@ -0,0 +1,32 @@
+package main
+
+import (
+	"time"
+)
+
+// Clock is where the watch loop and the state it keeps between scans get the time from, so that tests
+// can control it.
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+	After(d time.Duration) <-chan time.Time
+}
+
+// systemClock is the Clock of the code that waits or keeps time outside the watch loop's ScanState, e.g.
+// database retries and ops alert rate limiting. watchReplayDir sets it to the clock it's given.
+var systemClock Clock = RealClock{}
+
+// RealClock is the system clock.
+type RealClock struct{}
+
+func (RealClock) Now() time.Time {
+	return time.Now()
+}
+
+func (RealClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+func (RealClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+const REDACTED string = "****"
+
+// redactedConfig has Config's fields but none of its methods, so that it can be formatted without
+// recursing back into Config.String.
+type redactedConfig Config
+
+// redacted returns a copy of the config with its secrets masked.
+func (c Config) redacted() redactedConfig {
+	redacted := redactedConfig(c)
+	redacted.AuthToken = maskToken(c.AuthToken)
+	redacted.MattermostToken = maskToken(c.MattermostToken)
+	redacted.RedisPassword = maskToken(c.RedisPassword)
+	redacted.S3SecretAccessKey = maskToken(c.S3SecretAccessKey)
+	redacted.OnUploadWebhook = maskUrl(c.OnUploadWebhook)
+
+	return redacted
+}
+
+func (c Config) String() string {
+	return fmt.Sprintf("%+v", c.redacted())
+}
+
+func (c Config) GoString() string {
+	return fmt.Sprintf("%#v", c.redacted())
+}
+
+func (c Config) MarshalJSON() ([]byte, error) {
+	return json.Marshal(c.redacted())
+}
+
+// maskToken hides everything in a secret but a Slack-style type prefix, e.g. "xoxb-1234" becomes
+// "xoxb-****".
+func maskToken(token string) string {
+	if token == "" {
+		return ""
+	}
+
+	if prefixEnd := strings.Index(token, "-"); prefixEnd > 0 && prefixEnd <= 5 {
+		return token[:prefixEnd+1] + REDACTED
+	}
+
+	return REDACTED
+}
+
+// maskUrl hides everything in a URL but its scheme and host, since webhook URLs carry their secret in
+// the path or query, e.g. "https://hooks.slack.com/services/T0/B0/x" becomes "https://hooks.slack.com/****".
+func maskUrl(rawUrl string) string {
+	if rawUrl == "" {
+		return ""
+	}
+
+	if parsed, err := url.Parse(rawUrl); err == nil && parsed.Scheme != "" && parsed.Host != "" {
+		return parsed.Scheme + "://" + parsed.Host + "/" + REDACTED
+	}
+
+	return REDACTED
+}
+
+// summary describes the effective configuration in a line for the startup log: where replays are
+// picked up from and posted to, and which optional features are on. Secrets are masked, and URLs that
+// may embed them, such as OnUploadWebhook, are left out.
+func (c Config) summary() string {
+	token := maskToken(c.AuthToken)
+	if c.Target == TARGET_MATTERMOST {
+		token = maskToken(c.MattermostToken)
+	}
+
+	features := []string{}
+	feature := func(enabled bool, format string, args ...interface{}) {
+		if enabled {
+			features = append(features, fmt.Sprintf(format, args...))
+		}
+	}
+	feature(c.Target == TARGET_SLACK && c.UploadMethod != UPLOAD_METHOD_FILES_UPLOAD, "UploadMethod %s", c.UploadMethod)
+	feature(c.MessageFormat != MESSAGE_FORMAT_FILE, "MessageFormat %s", c.MessageFormat)
+	feature(c.GzipUploads, "GzipUploads")
+	feature(c.BatchUpload, "BatchUpload")
+	feature(c.BundleThread, "BundleThread")
+	feature(c.DigestMode, "DigestMode")
+	feature(c.OptimizeGifs, "OptimizeGifs")
+	feature(c.AttachThumbnail, "AttachThumbnail")
+	feature(c.AutoJoinChannel, "AutoJoinChannel")
+	feature(c.ExcludePattern != "" || len(c.ExcludeGlobs) > 0 || len(c.IncludeGlobs) > 0, "include/exclude patterns")
+	feature(c.MaxUploadsPerCycle > 0, "MaxUploadsPerCycle %d", c.MaxUploadsPerCycle)
+	feature(c.UploadsPerMinute > 0, "UploadsPerMinute %d", c.UploadsPerMinute)
+	feature(c.DedupBackend != DEDUP_BACKEND_SQLITE, "DedupBackend %s", c.DedupBackend)
+	feature(c.MaxUploadAttempts > 0 && c.DeadLetterDir != "", "dead-lettering after %d attempts", c.MaxUploadAttempts)
+	feature(c.ContinueOnError, "ContinueOnError")
+	feature(c.AfterUpload != AFTER_UPLOAD_NONE, "AfterUpload %s", c.AfterUpload)
+	feature(c.OpsChannelID != "", "ops alerts to '%s'", c.OpsChannelID)
+	feature(c.OnUploadWebhook != "", "OnUploadWebhook")
+	feature(len(c.OnFailureCommand) > 0, "OnFailureCommand")
+	feature(c.StatusListenAddress != "", "status on '%s'", c.StatusListenAddress)
+	feature(c.AuditLogPath != "", "audit log '%s'", c.AuditLogPath)
+	feature(c.LogFilePath != "", "log file '%s'", c.LogFilePath)
+	feature(c.OTLPEndpoint != "", "tracing")
+
+	if len(features) == 0 {
+		features = append(features, "none")
+	}
+
+	return fmt.Sprintf("replays matching '%s' in '%s', checked every %d seconds, posted to %s channel '%s' with token '%s'; database '%s'; features: %s",
+		c.ReplayGlob, c.ReplayDirectoryPath, c.CheckIntervalSeconds, c.Target, c.ChannelID, token, c.DatabasePath, strings.Join(features, ", "))
+}
@@ -0,0 +1,56 @@
+package main
+
+// reloadConfig re-reads the configuration at confPath to replace current. If the new configuration
+// can't be read or is invalid, current is kept. Fields that are only used at startup keep their
+// current values, with a warning that a restart is needed to change them.
+func reloadConfig(confPath string, current *Config) *Config {
+	logInfof("Reloading the configuration at '%s'", confPath)
+
+	reloaded, err := readConfig(confPath)
+	if err != nil {
+		logErrorf("Error reloading the configuration at '%s', keeping the current configuration: %s", confPath, err)
+		return current
+	}
+
+	warnRestartRequired := func(field string) {
+		logWarnf("changing %s requires a restart, keeping the current value", field)
+	}
+
+	if reloaded.DatabasePath != current.DatabasePath {
+		warnRestartRequired("DatabasePath")
+		reloaded.DatabasePath = current.DatabasePath
+	}
+	if reloaded.DbMaxOpenConns != current.DbMaxOpenConns {
+		warnRestartRequired("DbMaxOpenConns")
+		reloaded.DbMaxOpenConns = current.DbMaxOpenConns
+	}
+	if reloaded.DbBusyTimeoutMs != current.DbBusyTimeoutMs {
+		warnRestartRequired("DbBusyTimeoutMs")
+		reloaded.DbBusyTimeoutMs = current.DbBusyTimeoutMs
+	}
+	if reloaded.StatusListenAddress != current.StatusListenAddress {
+		warnRestartRequired("StatusListenAddress")
+		reloaded.StatusListenAddress = current.StatusListenAddress
+	}
+	if reloaded.LogFilePath != current.LogFilePath || reloaded.LogFileMaxSizeMB != current.LogFileMaxSizeMB ||
+		reloaded.LogFileMaxBackups != current.LogFileMaxBackups || reloaded.LogFileMaxAgeDays != current.LogFileMaxAgeDays || reloaded.LogFileEcho != current.LogFileEcho {
+		warnRestartRequired("the log file settings")
+		reloaded.LogFilePath, reloaded.LogFileMaxSizeMB, reloaded.LogFileEcho = current.LogFilePath, current.LogFileMaxSizeMB, current.LogFileEcho
+		reloaded.LogFileMaxBackups, reloaded.LogFileMaxAgeDays = current.LogFileMaxBackups, current.LogFileMaxAgeDays
+	}
+	if reloaded.MaxConnsPerHost != current.MaxConnsPerHost || reloaded.MaxIdleConnsPerHost != current.MaxIdleConnsPerHost ||
+		reloaded.MaxConcurrentRequests != current.MaxConcurrentRequests {
+		warnRestartRequired("the HTTP connection limits")
+		reloaded.MaxConnsPerHost, reloaded.MaxIdleConnsPerHost = current.MaxConnsPerHost, current.MaxIdleConnsPerHost
+		reloaded.MaxConcurrentRequests = current.MaxConcurrentRequests
+	}
+	if reloaded.OTLPEndpoint != current.OTLPEndpoint {
+		warnRestartRequired("OTLPEndpoint")
+		reloaded.OTLPEndpoint = current.OTLPEndpoint
+	}
+
+	setLogLevel(reloaded.LogLevel)
+
+	logInfof("Reloaded the configuration at '%s'", confPath)
+	return reloaded
+}
@@ -0,0 +1,14 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// crossDevice reports whether err is a rename failing because its source and destination are on
+// different devices.
+func crossDevice(err error) bool {
+	return errors.Is(err, syscall.EXDEV)
+}
@@ -0,0 +1,17 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// The error MoveFileEx fails with when asked to move a file to another volume.
+const ERROR_NOT_SAME_DEVICE syscall.Errno = 17
+
+// crossDevice reports whether err is a rename failing because its source and destination are on
+// different volumes.
+func crossDevice(err error) bool {
+	return errors.Is(err, ERROR_NOT_SAME_DEVICE)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const CREATE_SCHEMA_MIGRATIONS_SQL string = `CREATE TABLE IF NOT EXISTS schema_migrations(
+	version integer PRIMARY KEY,
+	applied_at integer NOT NULL
+);`
+
+// SchemaMigration brings the database from the previous version of its schema to version. Migrations
+// must be safe to run on a database that already has their changes, since databases created before
+// schema_migrations was added have no record of which they've had.
+type SchemaMigration struct {
+	version     int
+	description string
+	apply       func(db *sql.DB, config *Config) error
+}
+
+func execMigration(statement string) func(db *sql.DB, config *Config) error {
+	return func(db *sql.DB, config *Config) error {
+		_, err := db.Exec(statement)
+		return err
+	}
+}
+
+// SCHEMA_MIGRATIONS are applied in order; append new ones at the end and never change released ones.
+var SCHEMA_MIGRATIONS = []SchemaMigration{
+	{1, "create posted_replays", execMigration("CREATE TABLE IF NOT EXISTS posted_replays(replay_file_name varchar(512), channel_id varchar(64) NOT NULL DEFAULT '', target varchar(16) NOT NULL DEFAULT '');")},
+	{2, "record the channel and target of posted replays", migratePostedReplaysChannel},
+	{3, "create upload_queue", execMigration(CREATE_UPLOAD_QUEUE_SQL)},
+	{4, "create archived_replays", execMigration(CREATE_ARCHIVED_REPLAYS_SQL)},
+	{5, "create external_uploads", execMigration(CREATE_EXTERNAL_UPLOADS_SQL)},
+	{6, "create external_upload_progress", execMigration(CREATE_EXTERNAL_UPLOAD_PROGRESS_SQL)},
+	{7, "make posted_replays unique per replay and channel", func(db *sql.DB, config *Config) error {
+		if _, err := db.Exec(DEDUPLICATE_POSTED_REPLAYS_SQL); err != nil {
+			return err
+		}
+		_, err := db.Exec(CREATE_POSTED_REPLAYS_INDEX_SQL)
+		return err
+	}},
+	{8, "make replay_file_name text", migrateReplayFileNamesToText},
+	{9, "record the channel of external uploads", migrateExternalUploadsChannel},
+	{10, "record the channel of chunked external upload progress", migrateExternalUploadProgressChannel},
+}
+
+// migrateDb checks that the database's schema is one this version of the uploader can work with, then
+// applies the migrations it hasn't had yet.
+func migrateDb(db *sql.DB, config *Config) error {
+	if _, err := db.Exec(CREATE_SCHEMA_MIGRATIONS_SQL); err != nil {
+		return err
+	}
+
+	var version int
+	if err := db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations;").Scan(&version); err != nil {
+		return err
+	}
+
+	latest := SCHEMA_MIGRATIONS[len(SCHEMA_MIGRATIONS)-1].version
+	if version > latest {
+		return errors.New(fmt.Sprintf("Database schema version %d is newer than this uploader supports (%d), upgrade the uploader or use another DatabasePath", version, latest))
+	}
+
+	if err := checkPostedReplaysCompatible(db); err != nil {
+		return err
+	}
+
+	for _, migration := range SCHEMA_MIGRATIONS {
+		if migration.version <= version {
+			continue
+		}
+
+		if err := migration.apply(db, config); err != nil {
+			return errors.New(fmt.Sprintf("Error migrating the database to schema version %d (%s): %s", migration.version, migration.description, err))
+		}
+		if _, err := db.Exec("INSERT INTO schema_migrations(version, applied_at) VALUES(?, ?);", migration.version, time.Now().Unix()); err != nil {
+			return err
+		}
+		logDebugf("Migrated the database to schema version %d: %s", migration.version, migration.description)
+	}
+
+	return nil
+}
+
+// migrateReplayFileNamesToText rebuilds posted_replays and upload_queue with replay_file_name declared as
+// text rather than varchar(512). SQLite never enforced the length, so no rows change; the declared type
+// now matches what the column holds, e.g. for tools reading the database.
+func migrateReplayFileNamesToText(db *sql.DB, config *Config) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, statement := range []string{
+		"CREATE TABLE posted_replays_text(replay_file_name text, channel_id varchar(64) NOT NULL DEFAULT '', target varchar(16) NOT NULL DEFAULT '');",
+		"INSERT INTO posted_replays_text SELECT replay_file_name, channel_id, target FROM posted_replays;",
+		"DROP TABLE posted_replays;",
+		"ALTER TABLE posted_replays_text RENAME TO posted_replays;",
+		CREATE_POSTED_REPLAYS_INDEX_SQL,
+		`CREATE TABLE upload_queue_text(
+			replay_file_name text PRIMARY KEY,
+			status varchar(16) NOT NULL,
+			attempts integer NOT NULL DEFAULT 0,
+			last_error text,
+			discovered_at integer NOT NULL,
+			updated_at integer NOT NULL
+		);`,
+		"INSERT INTO upload_queue_text SELECT replay_file_name, status, attempts, last_error, discovered_at, updated_at FROM upload_queue;",
+		"DROP TABLE upload_queue;",
+		"ALTER TABLE upload_queue_text RENAME TO upload_queue;",
+	} {
+		if _, err := tx.Exec(statement); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// checkPostedReplaysCompatible checks that an existing posted_replays table is one the migrations can
+// work from, rather than some other table of the same name.
+func checkPostedReplaysCompatible(db *sql.DB) error {
+	columns, err := tableColumns(db, "posted_replays")
+	if err != nil {
+		return err
+	}
+
+	if len(columns) > 0 && !columns["replay_file_name"] {
+		return errors.New("Database has a posted_replays table without a replay_file_name column, which this uploader can't migrate; use another DatabasePath")
+	}
+
+	return nil
+}
+
+// tableColumns returns the names of a table's columns, or none if it doesn't exist.
+func tableColumns(db *sql.DB, table string) (map[string]bool, error) {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s);", table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var cid, notNull, primaryKey int
+		var name, columnType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &primaryKey); err != nil {
+			return nil, err
+		}
+		columns[name] = true
+	}
+
+	return columns, rows.Err()
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"time"
+)
+
+const DEFAULT_DB_BUSY_RETRIES int = 3
+const DEFAULT_DB_BUSY_RETRY_DELAY_MS int = 100
+const DEFAULT_RECORD_RETRIES int = 3
+const DEFAULT_RECORD_RETRY_DELAY_MS int = 500
+
+// retryDbBusy runs a database operation, retrying it up to DbBusyRetries times, DbBusyRetryDelayMs
+// apart, for as long as it fails because the database is locked by another connection or process.
+// Any other error is returned straight away.
+func retryDbBusy(config *Config, operation func() error) error {
+	err := operation()
+	for retry := 1; retry <= config.DbBusyRetries && dbBusy(err); retry++ {
+		logDebugf("Database is busy, retrying (%d/%d): %s", retry, config.DbBusyRetries, err)
+		systemClock.Sleep(time.Duration(config.DbBusyRetryDelayMs) * time.Millisecond)
+		err = operation()
+	}
+
+	return err
+}
+
+// retryRecordWrite runs the write recording that a replay was posted, retrying it up to RecordRetries
+// times on any error but a full disk, waiting RecordRetryDelayMs before the first retry and twice as long
+// before each one after. The replay is already in Slack by then, so giving up means posting it twice.
+func retryRecordWrite(config *Config, operation func() error) error {
+	err := operation()
+	delay := time.Duration(config.RecordRetryDelayMs) * time.Millisecond
+	for retry := 1; retry <= config.RecordRetries && err != nil && !diskFull(err); retry++ {
+		logWarnf("couldn't record a posted replay, retrying in %s (%d/%d): %s", delay, retry, config.RecordRetries, err)
+		systemClock.Sleep(delay)
+		delay *= 2
+		err = operation()
+	}
+
+	return err
+}
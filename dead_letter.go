@@ -0,0 +1,101 @@
+package main
+
+import (
+	"database/sql"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// deadLetterIfExhausted moves a replay into DeadLetterDir once it has failed to upload
+// MaxUploadAttempts times, and reports whether it did so. A replay of the same name already there is
+// dealt with by MoveCollisionStrategy, as for ArchiveDir.
+func deadLetterIfExhausted(replayFilePath string, db *sql.DB, config *Config) (bool, error) {
+	if config.DeadLetterDir == "" || config.MaxUploadAttempts <= 0 {
+		return false, nil
+	}
+
+	replayName := filepath.Base(replayFilePath)
+	attempts, err := replayUploadAttempts(replayName, db)
+	if err != nil || attempts < config.MaxUploadAttempts {
+		return false, err
+	}
+
+	deadLetterPath := filepath.Join(config.DeadLetterDir, replayName)
+	if filepath.Clean(replayFilePath) == filepath.Clean(deadLetterPath) {
+		// a retry of a replay that's already been dead-lettered
+		return false, markReplayDeadLettered(replayName, db)
+	}
+	if deadLetterPath = archiveCollisionPath(deadLetterPath, config); deadLetterPath == "" {
+		logWarnf("a replay named '%s' is already in dead-letter directory '%s', leaving replay '%s' in place", replayName, config.DeadLetterDir, replayFilePath)
+		return false, nil
+	}
+	if err := moveFile(replayFilePath, deadLetterPath); err != nil {
+		return false, err
+	}
+	logInfof("Moved replay '%s' to '%s' after %d failed upload attempts", replayFilePath, deadLetterPath, attempts)
+
+	return true, markReplayDeadLettered(replayName, db)
+}
+
+// moveFile renames src to dst, falling back to copying and deleting when they're on different devices.
+// The copy goes to a temporary file beside dst that's renamed over it once complete, so that a failed
+// copy never touches a file already at dst.
+func moveFile(src string, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	if err := os.Rename(src, dst); !crossDevice(err) {
+		return err
+	}
+
+	tempPath, err := copyFileToTemp(src, filepath.Dir(dst))
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tempPath, dst); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+
+	return os.Remove(src)
+}
+
+// copyFileToTemp copies src to a new temporary file in dir and returns its path. The temporary file is
+// removed again if the copy fails.
+func copyFileToTemp(src string, dir string) (string, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	out, err := os.CreateTemp(dir, "."+filepath.Base(src)+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	// CreateTemp makes the file readable by its owner only
+	if err := out.Chmod(info.Mode().Perm()); err != nil {
+		out.Close()
+		os.Remove(out.Name())
+		return "", err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(out.Name())
+		return "", err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(out.Name())
+		return "", err
+	}
+
+	return out.Name(), nil
+}
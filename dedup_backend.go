@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const DEDUP_BACKEND_SQLITE string = "sqlite"
+const DEDUP_BACKEND_REDIS string = "redis"
+
+const DEFAULT_REDIS_KEY_PREFIX string = "towerfall_replay_slack_uploader:posted:"
+const REDIS_TIMEOUT_SECONDS time.Duration = time.Duration(10)
+
+// DedupStore remembers which replays have been posted, so that none is posted twice.
+type DedupStore interface {
+	isUploaded(replayFileName string) (bool, error)
+	markUploaded(replayFileName string) error
+}
+
+func newDedupStore(db *sql.DB, config *Config) DedupStore {
+	sqliteStore := &SqliteDedupStore{db: db, config: config}
+	if config.DedupBackend == DEDUP_BACKEND_REDIS {
+		return &RedisDedupStore{local: sqliteStore, config: config}
+	}
+
+	return sqliteStore
+}
+
+// SqliteDedupStore keeps the posted replays in the posted_replays table of the local database.
+type SqliteDedupStore struct {
+	db     *sql.DB
+	config *Config
+}
+
+func (s *SqliteDedupStore) isUploaded(replayFileName string) (bool, error) {
+	return checkReplayAlreadyUploaded(replayFileName, s.db, s.config)
+}
+
+func (s *SqliteDedupStore) markUploaded(replayFileName string) error {
+	return recordReplayWasUploaded(replayFileName, s.db, s.config)
+}
+
+// RedisDedupStore keeps the posted replays in a Redis set per channel, so that several uploaders
+// watching the same replays share what's been posted. Each upload is also recorded in the local
+// database, which keeps the upload count and history for this uploader.
+type RedisDedupStore struct {
+	local  *SqliteDedupStore
+	config *Config
+}
+
+func (s *RedisDedupStore) key() string {
+	return s.config.RedisKeyPrefix + s.config.ChannelID
+}
+
+func (s *RedisDedupStore) isUploaded(replayFileName string) (bool, error) {
+	reply, err := s.command("SISMEMBER", s.key(), replayFileName)
+	if err != nil {
+		return false, errors.New(fmt.Sprintf("Error checking Redis for replay '%s': %s", replayFileName, err))
+	}
+
+	return reply == "1", nil
+}
+
+func (s *RedisDedupStore) markUploaded(replayFileName string) error {
+	if _, err := s.command("SADD", s.key(), replayFileName); err != nil {
+		return errors.New(fmt.Sprintf("Error recording that replay '%s' was uploaded in Redis: %s", replayFileName, err))
+	}
+
+	return s.local.markUploaded(replayFileName)
+}
+
+// command runs a single command on a new connection to RedisAddress, authenticating and selecting
+// RedisDB first if they're set, and returns its integer, simple string or bulk string reply.
+func (s *RedisDedupStore) command(args ...string) (string, error) {
+	conn, err := net.DialTimeout("tcp", s.config.RedisAddress, REDIS_TIMEOUT_SECONDS*time.Second)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(REDIS_TIMEOUT_SECONDS * time.Second))
+
+	reader := bufio.NewReader(conn)
+	run := func(args ...string) (string, error) {
+		var request strings.Builder
+		fmt.Fprintf(&request, "*%d\r\n", len(args))
+		for _, arg := range args {
+			fmt.Fprintf(&request, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+		if _, err := conn.Write([]byte(request.String())); err != nil {
+			return "", err
+		}
+
+		return readRedisReply(reader)
+	}
+
+	if s.config.RedisPassword != "" {
+		if _, err := run("AUTH", s.config.RedisPassword); err != nil {
+			return "", err
+		}
+	}
+	if s.config.RedisDB != 0 {
+		if _, err := run("SELECT", strconv.Itoa(s.config.RedisDB)); err != nil {
+			return "", err
+		}
+	}
+
+	return run(args...)
+}
+
+// readRedisReply reads a RESP reply that isn't an array.
+func readRedisReply(reader *bufio.Reader) (string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return "", errors.New("empty reply")
+	}
+
+	switch line[0] {
+	case '+', ':':
+		return line[1:], nil
+	case '-':
+		return "", errors.New(line[1:])
+	case '$':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return "", errors.New(fmt.Sprintf("unexpected reply '%s'", line))
+		} else if length < 0 {
+			return "", nil
+		}
+
+		value := make([]byte, length+2)
+		if _, err := io.ReadFull(reader, value); err != nil {
+			return "", err
+		}
+		return string(value[:length]), nil
+	default:
+		return "", errors.New(fmt.Sprintf("unexpected reply '%s'", line))
+	}
+}
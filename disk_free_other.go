@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !freebsd && !dragonfly && !windows
+
+package main
+
+import (
+	"errors"
+)
+
+func freeDiskBytes(path string) (uint64, error) {
+	return 0, errors.New("checking free disk space isn't supported on this platform")
+}
@@ -0,0 +1,17 @@
+//go:build linux || darwin || freebsd || dragonfly
+
+package main
+
+import (
+	"syscall"
+)
+
+// freeDiskBytes returns how many bytes are free for unprivileged use on the volume holding path.
+func freeDiskBytes(path string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
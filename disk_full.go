@@ -0,0 +1,126 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"syscall"
+)
+
+// DiskFullError is returned when a write fails because the disk holding Path is full.
+type DiskFullError struct {
+	Path string
+	err  error
+}
+
+func (e *DiskFullError) Error() string {
+	return fmt.Sprintf("Disk holding '%s' is full: %s", e.Path, e.err)
+}
+
+func (e *DiskFullError) Unwrap() error {
+	return e.err
+}
+
+// diskFull reports whether err is, or wraps, a write failing because a disk is full.
+func diskFull(err error) bool {
+	var diskFullErr *DiskFullError
+	return errors.As(err, &diskFullErr) || errors.Is(err, syscall.ENOSPC) || dbFull(err)
+}
+
+// DiskSpaceMonitor tracks which of the paths the uploader writes to are on a full disk, for the logs and
+// the status endpoints, along with the replays that were posted but couldn't be recorded as uploaded
+// because the database's disk was full. Those are recorded at the start of each scan until it has space
+// again, and aren't posted a second time meanwhile.
+type DiskSpaceMonitor struct {
+	mutex      sync.Mutex
+	fullPaths  map[string]bool
+	unrecorded map[string]string
+}
+
+var diskSpace = &DiskSpaceMonitor{fullPaths: make(map[string]bool), unrecorded: make(map[string]string)}
+
+// reportFull notes that the disk holding path is full.
+func (m *DiskSpaceMonitor) reportFull(path string, err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if !m.fullPaths[path] {
+		logErrorf("CRITICAL: the disk holding '%s' is full, free up space there; retrying on every scan until then: %s", path, err)
+	}
+	m.fullPaths[path] = true
+}
+
+// reportOk notes that a write to path succeeded.
+func (m *DiskSpaceMonitor) reportOk(path string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.fullPaths[path] {
+		logInfof("The disk holding '%s' has space again", path)
+		delete(m.fullPaths, path)
+	}
+}
+
+func (m *DiskSpaceMonitor) isFull() bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return len(m.fullPaths) > 0
+}
+
+// addUnrecorded notes a replay that was posted but not recorded, by its dedup key.
+func (m *DiskSpaceMonitor) addUnrecorded(dedupKey string, replayName string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.unrecorded[dedupKey] = replayName
+}
+
+func (m *DiskSpaceMonitor) isUnrecorded(dedupKey string) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	_, unrecorded := m.unrecorded[dedupKey]
+	return unrecorded
+}
+
+// recordUnrecordedUploads records the replays that were posted while the database's disk was full.
+func (m *DiskSpaceMonitor) recordUnrecordedUploads(db *sql.DB, config *Config) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for dedupKey, replayName := range m.unrecorded {
+		if err := newDedupStore(db, config).markUploaded(dedupKey); err != nil {
+			return err
+		}
+		if err := markReplayDone(replayName, db); err != nil {
+			logErrorf("%s", err)
+		}
+
+		logInfof("Recorded that replay '%s' was uploaded now that the database has space", replayName)
+		delete(m.unrecorded, dedupKey)
+	}
+
+	return nil
+}
+
+// keepWatchingIfDiskFull returns nil for a scan error caused by a full disk, so the watch loop carries on
+// and retries on the next scan rather than exiting, and any other error as it is.
+func keepWatchingIfDiskFull(err error, config *Config) error {
+	if err == nil {
+		diskSpace.reportOk(config.DatabasePath)
+		return nil
+	}
+
+	var diskFullErr *DiskFullError
+	if errors.As(err, &diskFullErr) {
+		diskSpace.reportFull(diskFullErr.Path, err)
+		return nil
+	} else if diskFull(err) {
+		diskSpace.reportFull(config.DatabasePath, err)
+		return nil
+	}
+
+	return err
+}
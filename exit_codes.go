@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+)
+
+// Exit codes, so that supervisors and CI can tell failure classes apart. Anything unclassified exits
+// with EXIT_CODE_FAILURE.
+const EXIT_CODE_FAILURE int = 1
+const EXIT_CODE_CONFIG int = 2
+const EXIT_CODE_DATABASE int = 3
+const EXIT_CODE_UPLOAD int = 4
+const EXIT_CODE_REPLAY_DIRECTORY int = 5
+
+// ConfigError is an invalid or unreadable configuration.
+type ConfigError struct {
+	err error
+}
+
+func (e *ConfigError) Error() string { return e.err.Error() }
+func (e *ConfigError) Unwrap() error { return e.err }
+
+// DatabaseError is a failure to read from or write to the database of posted replays.
+type DatabaseError struct {
+	err error
+}
+
+func (e *DatabaseError) Error() string { return e.err.Error() }
+func (e *DatabaseError) Unwrap() error { return e.err }
+
+// UploadError is a replay that failed to upload and wasn't dead-lettered.
+type UploadError struct {
+	ReplayFilePath string
+	err            error
+}
+
+func (e *UploadError) Error() string { return e.err.Error() }
+func (e *UploadError) Unwrap() error { return e.err }
+
+// ReplayDirectoryError is a replay directory that's missing or isn't a directory.
+type ReplayDirectoryError struct {
+	err error
+}
+
+func (e *ReplayDirectoryError) Error() string { return e.err.Error() }
+func (e *ReplayDirectoryError) Unwrap() error { return e.err }
+
+// exitCode returns the exit code for the error that stopped the uploader.
+func exitCode(err error) int {
+	var configErr *ConfigError
+	var databaseErr *DatabaseError
+	var uploadErr *UploadError
+	var replayDirectoryErr *ReplayDirectoryError
+
+	switch {
+	case errors.As(err, &configErr):
+		return EXIT_CODE_CONFIG
+	case errors.As(err, &databaseErr):
+		return EXIT_CODE_DATABASE
+	case errors.As(err, &uploadErr):
+		return EXIT_CODE_UPLOAD
+	case errors.As(err, &replayDirectoryErr):
+		return EXIT_CODE_REPLAY_DIRECTORY
+	default:
+		return EXIT_CODE_FAILURE
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+)
+
+// retryFailedReplays gives every replay that failed to upload, or was moved to DeadLetterDir, one more
+// attempt, as long as it still passes the checks a scan makes and the upload limits allow. Replays that
+// fail again, or are held back, are left failed for the next retry; only database errors are returned.
+func retryFailedReplays(ctx context.Context, db *sql.DB, config *Config, state *ScanState) error {
+	replayNames, err := failedReplayNames(db)
+	if err != nil {
+		return &DatabaseError{err}
+	}
+
+	if len(replayNames) > 0 {
+		logInfof("Retrying %d replay(s) that failed to upload", len(replayNames))
+	}
+
+	limit, attempted := state.uploadLimiter.allowed(config), 0
+	for _, replayName := range replayNames {
+		replayFilePath := failedReplayPath(replayName, config)
+		if replayFilePath == "" {
+			logWarnf("failed replay '%s' is no longer in the replay or dead-letter directory, forgetting it", replayName)
+			if err := dequeueReplay(replayName, db); err != nil {
+				return &DatabaseError{err}
+			}
+			continue
+		}
+
+		if eligible, err := replayEligible(replayFilePath, true, db, config, state); err != nil {
+			return err
+		} else if !eligible {
+			continue
+		}
+
+		if limit >= 0 && attempted >= limit {
+			logInfof("Throttling uploads, deferring the remaining failed replays to a later retry")
+			break
+		}
+
+		if !state.inFlight.add(replayFilePath) {
+			continue
+		}
+		attempted++
+
+		_, err := uploadAndRecordReplay(ctx, replayFilePath, "", db, config)
+		state.inFlight.remove(replayFilePath)
+		state.uploadLimiter.recordUpload()
+
+		var uploadErr *UploadError
+		if errors.As(err, &uploadErr) {
+			logErrorf("Error retrying replay '%s': %s", replayFilePath, uploadErr.err)
+		} else if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// failedReplayPath finds a failed replay in ReplayDirectoryPath, or in DeadLetterDir if it was moved
+// there, returning "" if it's in neither.
+func failedReplayPath(replayName string, config *Config) string {
+	if replayFilePath := filepath.Join(config.ReplayDirectoryPath, replayName); fileExists(replayFilePath) {
+		return replayFilePath
+	}
+
+	if config.DeadLetterDir != "" {
+		if replayFilePath := filepath.Join(config.DeadLetterDir, replayName); fileExists(replayFilePath) {
+			return replayFilePath
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"sync"
+)
+
+// LimitTransport lets at most cap(slots) requests be in flight at once, from when they're sent until
+// their response body is closed. Requests over the limit wait for a slot, or until they're cancelled.
+type LimitTransport struct {
+	base  http.RoundTripper
+	slots chan struct{}
+}
+
+func (t *LimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	select {
+	case t.slots <- struct{}{}:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		<-t.slots
+		return nil, err
+	}
+
+	resp.Body = &releaseOnClose{ReadCloser: resp.Body, release: func() { <-t.slots }}
+	return resp, nil
+}
+
+// releaseOnClose calls release the first time the body is closed.
+type releaseOnClose struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (b *releaseOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// configureHttpClient applies the connection settings to httpClient. It's called once at startup,
+// before any request is sent.
+func configureHttpClient(config *Config) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxConnsPerHost = config.MaxConnsPerHost
+	if config.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = config.MaxIdleConnsPerHost
+	}
+
+	var base http.RoundTripper = transport
+	if config.MaxConcurrentRequests > 0 {
+		base = &LimitTransport{base: transport, slots: make(chan struct{}, config.MaxConcurrentRequests)}
+	}
+
+	httpClient.Transport = &UserAgentTransport{base: base}
+}
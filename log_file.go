@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const DEFAULT_LOG_FILE_MAX_SIZE_MB int = 10
+const DEFAULT_LOG_FILE_MAX_BACKUPS int = 5
+
+// RotatingFile is a log file that's rotated once writing to it would take it past maxBytes: the current
+// file is renamed to "<path>.1", the older backups move up a number, and a new file is started. Backups
+// beyond maxBackups, or older than maxAge if that's set, are removed at each rotation.
+type RotatingFile struct {
+	mutex      sync.Mutex
+	path       string
+	maxBytes   int64
+	maxBackups int
+	maxAge     time.Duration
+	file       *os.File
+	size       int64
+}
+
+func openRotatingFile(path string, maxBytes int64, maxBackups int, maxAge time.Duration) (*RotatingFile, error) {
+	r := &RotatingFile{path: path, maxBytes: maxBytes, maxBackups: maxBackups, maxAge: maxAge}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *RotatingFile) open() error {
+	file, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	r.file, r.size = file, info.Size()
+	return nil
+}
+
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.size > 0 && r.size+int64(len(p)) > r.maxBytes {
+		if err := r.rotate(); err != nil {
+			// keep logging to the current file rather than lose messages
+			fmt.Fprintf(os.Stderr, "Error rotating log file '%s': %s\n", r.path, err)
+		}
+	}
+
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *RotatingFile) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+
+	os.Remove(r.backupPath(r.maxBackups))
+	for n := r.maxBackups - 1; n >= 1; n-- {
+		os.Rename(r.backupPath(n), r.backupPath(n+1))
+	}
+	if r.maxBackups > 0 {
+		os.Rename(r.path, r.backupPath(1))
+	} else {
+		os.Remove(r.path)
+	}
+
+	if r.maxAge > 0 {
+		for n := 1; n <= r.maxBackups; n++ {
+			if info, err := os.Stat(r.backupPath(n)); err == nil && time.Since(info.ModTime()) > r.maxAge {
+				os.Remove(r.backupPath(n))
+			}
+		}
+	}
+
+	return r.open()
+}
+
+func (r *RotatingFile) backupPath(n int) string {
+	return fmt.Sprintf("%s.%d", r.path, n)
+}
+
+// setUpLogFile sends the log to LogFilePath, as well as standard error if LogFileEcho is set.
+func setUpLogFile(config *Config) error {
+	if config.LogFilePath == "" {
+		return nil
+	}
+
+	logFile, err := openRotatingFile(config.LogFilePath, int64(config.LogFileMaxSizeMB)*1024*1024, config.LogFileMaxBackups,
+		time.Duration(config.LogFileMaxAgeDays)*24*time.Hour)
+	if err != nil {
+		return err
+	}
+
+	if config.LogFileEcho {
+		log.SetOutput(io.MultiWriter(os.Stderr, logFile))
+	} else {
+		log.SetOutput(logFile)
+	}
+
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"log"
+	"sync/atomic"
+)
+
+const LOG_LEVEL_DEBUG string = "debug"
+const LOG_LEVEL_INFO string = "info"
+const LOG_LEVEL_WARN string = "warn"
+const LOG_LEVEL_ERROR string = "error"
+
+// LOG_LEVELS orders the log levels from most to least verbose.
+var LOG_LEVELS = []string{LOG_LEVEL_DEBUG, LOG_LEVEL_INFO, LOG_LEVEL_WARN, LOG_LEVEL_ERROR}
+
+// logThreshold is the index in LOG_LEVELS of the least severe level that's logged. A SIGHUP reload
+// changes it while other goroutines log, so it's only accessed atomically.
+var logThreshold int32 = int32(logLevelIndex(LOG_LEVEL_INFO))
+
+// setLogLevel changes which messages are logged from now on. Unknown levels are ignored, since
+// readConfig has already rejected them.
+func setLogLevel(level string) {
+	if threshold := logLevelIndex(level); threshold >= 0 {
+		atomic.StoreInt32(&logThreshold, int32(threshold))
+	}
+}
+
+// logLevelEnabled reports whether messages at level are logged.
+func logLevelEnabled(level string) bool {
+	return int(atomic.LoadInt32(&logThreshold)) <= logLevelIndex(level)
+}
+
+func logLevelIndex(level string) int {
+	for idx, known := range LOG_LEVELS {
+		if level == known {
+			return idx
+		}
+	}
+
+	return -1
+}
+
+// logDebugf logs per-file detail that's only useful when troubleshooting.
+func logDebugf(format string, args ...interface{}) {
+	if logLevelEnabled(LOG_LEVEL_DEBUG) {
+		log.Printf(format, args...)
+	}
+}
+
+func logInfof(format string, args ...interface{}) {
+	if logLevelEnabled(LOG_LEVEL_INFO) {
+		log.Printf(format, args...)
+	}
+}
+
+func logWarnf(format string, args ...interface{}) {
+	if logLevelEnabled(LOG_LEVEL_WARN) {
+		log.Printf("Warning: "+format, args...)
+	}
+}
+
+func logErrorf(format string, args ...interface{}) {
+	log.Printf(format, args...)
+}
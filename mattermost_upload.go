@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strings"
+)
+
+type MattermostFileResponseBody struct {
+	FileInfos []struct {
+		Id string
+	} `json:"file_infos"`
+}
+
+type MattermostPostResponseBody struct {
+	Id     string
+	RootId string `json:"root_id"`
+}
+
+type MattermostErrorResponseBody struct {
+	Id      string
+	Message string
+}
+
+// MattermostUploader uploads replays to a Mattermost channel with its v4 REST API: the file is sent to
+// /api/v4/files, then shared in a post to ChannelID.
+type MattermostUploader struct{}
+
+func (u *MattermostUploader) upload(ctx context.Context, upload *ReplayUpload, db *sql.DB, config *Config) (result *UploadResult, err error) {
+	logInfof("Uploading replay '%s'", upload.FilePath)
+
+	ctx, span := startSpan(ctx, "mattermost.upload", SPAN_KIND_CLIENT)
+	defer func() { span.end(err) }()
+	span.setAttribute("replay.filename", upload.FileName)
+	span.setAttribute("mattermost.channel", config.ChannelID)
+
+	fileId, err := sendReplayToMattermost(ctx, upload, config)
+	if err != nil {
+		return nil, err
+	}
+
+	post := map[string]interface{}{
+		"channel_id": config.ChannelID,
+		"message":    upload.InitialComment,
+		"file_ids":   []string{fileId},
+	}
+	if upload.ThreadTs != "" {
+		post["root_id"] = upload.ThreadTs
+	}
+
+	postJson, err := json.Marshal(post)
+	if err != nil {
+		return nil, err
+	}
+
+	var postResponse MattermostPostResponseBody
+	if err := callMattermostApi(ctx, "posts", "application/json", bytes.NewReader(postJson), &postResponse, config); err != nil {
+		return nil, err
+	}
+
+	threadId := postResponse.RootId
+	if threadId == "" {
+		threadId = postResponse.Id
+	}
+
+	return &UploadResult{FileId: fileId, ThreadId: threadId}, nil
+}
+
+// sendReplayToMattermost uploads a replay's bytes to the channel, returning the id of the Mattermost file
+// they were stored as. The file isn't visible until it's attached to a post.
+func sendReplayToMattermost(ctx context.Context, upload *ReplayUpload, config *Config) (string, error) {
+	fh, err := os.Open(upload.FilePath)
+	if err != nil {
+		return "", err
+	}
+	defer fh.Close()
+
+	var replayFile io.Reader = fh
+	if info, err := fh.Stat(); err == nil {
+		replayFile = newProgressReader(fh, info.Size(), upload.FilePath, config)
+	}
+
+	// stream the multipart body through a pipe so the replay is never held in memory in full
+	bodyReader, bodyPipeWriter := io.Pipe()
+	bodyWriter := multipart.NewWriter(bodyPipeWriter)
+
+	go func() {
+		err := bodyWriter.WriteField("channel_id", config.ChannelID)
+		if err == nil {
+			var fileWriter io.Writer
+			if fileWriter, err = bodyWriter.CreateFormFile("files", upload.FileName); err == nil {
+				_, err = io.Copy(fileWriter, replayFile)
+			}
+		}
+		if err == nil {
+			err = bodyWriter.Close()
+		}
+		bodyPipeWriter.CloseWithError(err)
+	}()
+	defer bodyReader.Close()
+
+	var fileResponse MattermostFileResponseBody
+	if err := callMattermostApi(ctx, "files", bodyWriter.FormDataContentType(), bodyReader, &fileResponse, config); err != nil {
+		return "", err
+	}
+
+	if len(fileResponse.FileInfos) == 0 {
+		return "", errors.New(fmt.Sprintf("Error uploading replay '%s': Mattermost returned no file", upload.FilePath))
+	}
+
+	return fileResponse.FileInfos[0].Id, nil
+}
+
+// callMattermostApi POSTs a body to a Mattermost v4 API endpoint and decodes its JSON response into
+// responseBody.
+func callMattermostApi(ctx context.Context, endpoint string, contentType string, body io.Reader, responseBody interface{}, config *Config) error {
+	apiUrl := strings.TrimRight(config.MattermostURL, "/") + "/api/v4/" + endpoint
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, apiUrl, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Authorization", "Bearer "+config.MattermostToken)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var errorBody MattermostErrorResponseBody
+		if json.Unmarshal(respBytes, &errorBody) == nil && errorBody.Message != "" {
+			return errors.New(fmt.Sprintf("Error calling Mattermost %s: %d %s (%s)", endpoint, resp.StatusCode, errorBody.Message, errorBody.Id))
+		}
+		return errors.New(fmt.Sprintf("Error calling Mattermost %s: %d", endpoint, resp.StatusCode))
+	}
+
+	return json.Unmarshal(respBytes, responseBody)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"time"
+)
+
+const DEFAULT_FAILURE_COMMAND_TIMEOUT_SECONDS int = 30
+
+// runFailureCommand runs the configured OnFailureCommand to report that a replay
+// failed to upload for good. The replay's path and the error are appended to the command's arguments and are
+// also available as $TOWERFALL_REPLAY_FILE and $TOWERFALL_REPLAY_ERROR. A command still running after
+// OnFailureCommandTimeoutSeconds is killed, so that a hung one doesn't hold up the uploads.
+func runFailureCommand(replayFilePath string, uploadErr error, config *Config) {
+	if len(config.OnFailureCommand) == 0 {
+		return
+	}
+
+	args := append(append([]string{}, config.OnFailureCommand[1:]...), replayFilePath, uploadErr.Error())
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.OnFailureCommandTimeoutSeconds)*time.Second)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, config.OnFailureCommand[0], args...)
+	cmd.Env = append(os.Environ(),
+		"TOWERFALL_REPLAY_FILE="+replayFilePath,
+		"TOWERFALL_REPLAY_ERROR="+uploadErr.Error())
+	// Don't wait on children the command left behind still holding its output open once it's killed.
+	cmd.WaitDelay = time.Second
+
+	if output, err := cmd.CombinedOutput(); ctx.Err() == context.DeadlineExceeded {
+		logErrorf("OnFailureCommand for replay '%s' was killed after OnFailureCommandTimeoutSeconds (%d): %s", replayFilePath,
+			config.OnFailureCommandTimeoutSeconds, output)
+	} else if err != nil {
+		logErrorf("Error running OnFailureCommand for replay '%s': %s: %s", replayFilePath, err, output)
+	}
+}
+
+const WEBHOOK_TIMEOUT_SECONDS time.Duration = time.Duration(10)
+
+type UploadWebhookPayload struct {
+	Filename    string    `json:"filename"`
+	Channel     string    `json:"channel"`
+	SlackFileId string    `json:"slack_file_id"`
+	UploadedAt  time.Time `json:"uploaded_at"`
+}
+
+// postUploadWebhook tells the configured OnUploadWebhook that a replay was uploaded.
+func postUploadWebhook(replayFileName string, slackFileId string, config *Config) error {
+	payload, err := json.Marshal(UploadWebhookPayload{
+		Filename:    replayFileName,
+		Channel:     config.ChannelID,
+		SlackFileId: slackFileId,
+		UploadedAt:  time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: WEBHOOK_TIMEOUT_SECONDS * time.Second}
+	resp, err := client.Post(config.OnUploadWebhook, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		// the *url.Error would include the webhook's URL, whose path is usually its secret
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return errors.New(fmt.Sprintf("Error posting to webhook '%s': %s", maskUrl(config.OnUploadWebhook), err))
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.New(fmt.Sprintf("Webhook responded with %d", resp.StatusCode))
+	}
+
+	return nil
+}
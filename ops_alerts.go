@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const DEFAULT_OPS_ALERT_FAILURE_STREAK int = 3
+const DEFAULT_OPS_ALERT_MIN_INTERVAL_SECONDS int = 600
+
+// OpsAlerter posts operational alerts to OpsChannelID: when a replay is dead-lettered, when
+// OpsAlertFailureStreak uploads in a row have failed, and when uploads succeed again after such a streak.
+// Alerts are at least OpsAlertMinIntervalSeconds apart; those in between are only logged.
+type OpsAlerter struct {
+	mutex         sync.Mutex
+	failureStreak int
+	streakAlerted bool
+	lastAlert     time.Time
+}
+
+var opsAlerts = &OpsAlerter{}
+
+// recordFailure records a failed upload, alerting if it was dead-lettered or completes a failure streak.
+func (a *OpsAlerter) recordFailure(replayFilePath string, uploadErr error, deadLettered bool, config *Config) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.failureStreak++
+	if deadLettered {
+		a.alert(fmt.Sprintf(":warning: Replay '%s' was moved to the dead-letter directory after failing to upload: %s", filepath.Base(replayFilePath), uploadErr), config)
+	} else if a.failureStreak == config.OpsAlertFailureStreak {
+		a.streakAlerted = true
+		a.alert(fmt.Sprintf(":rotating_light: %d replay uploads in a row have failed, most recently '%s': %s", a.failureStreak, filepath.Base(replayFilePath), uploadErr), config)
+	}
+}
+
+// recordSuccess records a successful upload, alerting if it ends a failure streak that was alerted.
+func (a *OpsAlerter) recordSuccess(config *Config) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.streakAlerted {
+		a.alert(fmt.Sprintf(":white_check_mark: Replay uploads have recovered after %d failures", a.failureStreak), config)
+	}
+	a.failureStreak = 0
+	a.streakAlerted = false
+}
+
+func (a *OpsAlerter) alert(text string, config *Config) {
+	if config.OpsChannelID == "" {
+		return
+	}
+
+	now := systemClock.Now()
+	if !a.lastAlert.IsZero() && now.Sub(a.lastAlert) < time.Duration(config.OpsAlertMinIntervalSeconds)*time.Second {
+		logInfof("Not posting ops alert, the last one was under %d seconds ago: %s", config.OpsAlertMinIntervalSeconds, text)
+		return
+	}
+	a.lastAlert = now
+
+	if err := postOpsAlert(text, config); err != nil {
+		logErrorf("Error posting ops alert to channel '%s': %s", config.OpsChannelID, err)
+	}
+}
+
+func postOpsAlert(text string, config *Config) error {
+	ctx, cancel := context.WithTimeout(context.Background(), WEBHOOK_TIMEOUT_SECONDS*time.Second)
+	defer cancel()
+
+	params := url.Values{}
+	params.Set("channel", config.OpsChannelID)
+	params.Set("text", text)
+
+	var responseBody PostMessageResponseBody
+	if err := callSlackApi(ctx, "chat.postMessage", params, &responseBody, config); err != nil {
+		return err
+	}
+	if !responseBody.Ok {
+		return errors.New(slackErrorDetail(responseBody.Error, responseBody.Needed, responseBody.Provided))
+	}
+
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// The prefix of the dedup key of a replay with IncludeChecksumInTitle, which keeps the keys apart from
+// replay file names in posted_replays.
+const CHECKSUM_DEDUP_KEY_PREFIX string = "sha256:"
+
+type checksumEntry struct {
+	size     int64
+	modTime  time.Time
+	checksum string
+}
+
+// ChecksumCache remembers the SHA-256 of each replay for as long as its size and modification time
+// don't change, so that a scan doesn't hash every replay in the directory again.
+type ChecksumCache struct {
+	mutex   sync.Mutex
+	entries map[string]checksumEntry
+}
+
+var replayChecksums = &ChecksumCache{entries: make(map[string]checksumEntry)}
+
+// sha256 returns the hex SHA-256 of the file at filePath.
+func (c *ChecksumCache) sha256(filePath string) (string, error) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return "", err
+	}
+
+	c.mutex.Lock()
+	entry, cached := c.entries[filePath]
+	c.mutex.Unlock()
+	if cached && entry.size == info.Size() && entry.modTime.Equal(info.ModTime()) {
+		return entry.checksum, nil
+	}
+
+	fh, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer fh.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, fh); err != nil {
+		return "", err
+	}
+	checksum := hex.EncodeToString(hash.Sum(nil))
+
+	c.mutex.Lock()
+	c.entries[filePath] = checksumEntry{size: info.Size(), modTime: info.ModTime(), checksum: checksum}
+	c.mutex.Unlock()
+
+	return checksum, nil
+}
+
+// replayPosted reports whether a replay was recorded as posted under its dedup key, or under its name as
+// replays posted before IncludeChecksumInTitle was turned on were, so that turning it on doesn't post
+// them all again.
+func replayPosted(replayName string, dedupKey string, db *sql.DB, config *Config) (bool, error) {
+	store := newDedupStore(db, config)
+	if posted, err := store.isUploaded(dedupKey); err != nil || posted || dedupKey == replayName {
+		return posted, err
+	}
+
+	return store.isUploaded(replayName)
+}
+
+// replayDedupKey returns what a replay is recorded as posted under: its file name, or with
+// IncludeChecksumInTitle its checksum, so that the same replay under another name isn't posted again.
+func replayDedupKey(replayFilePath string, config *Config) (string, error) {
+	if !config.IncludeChecksumInTitle {
+		return filepath.Base(replayFilePath), nil
+	}
+
+	checksum, err := replayChecksums.sha256(replayFilePath)
+	if err != nil {
+		return "", err
+	}
+
+	return CHECKSUM_DEDUP_KEY_PREFIX + checksum, nil
+}
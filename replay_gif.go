@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"io"
+	"os"
+)
+
+// When tightening the optimization to reach OptimizeGifTargetBytes, the palette is halved down to
+// OPTIMIZE_GIF_MIN_COLORS colors first, then frames are dropped up to keeping every
+// OPTIMIZE_GIF_MAX_FRAME_STEP'th one.
+const OPTIMIZE_GIF_MIN_COLORS int = 16
+const OPTIMIZE_GIF_MAX_FRAME_STEP int = 8
+
+// optimizeReplay writes a size-reduced copy of the replay GIF to a temp file in TempDir and returns its
+// path, or an empty path if the copy wouldn't be smaller than the original. The original replay is left
+// untouched; the caller is responsible for removing the temp file, which is already removed on error.
+func optimizeReplay(replayFilePath string, config *Config) (string, error) {
+	src, err := os.Open(replayFilePath)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	originalInfo, err := src.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	dst, err := os.CreateTemp(config.TempDir, "towerfall_replay_*.gif")
+	if err != nil {
+		return "", err
+	}
+	keep := false
+	defer func() {
+		dst.Close()
+		if !keep {
+			os.Remove(dst.Name())
+		}
+	}()
+
+	frameStep, maxColors := config.OptimizeGifFrameStep, config.OptimizeGifMaxColors
+	var optimizedSize int64
+	for {
+		if optimizedSize, err = optimizeGifToFile(src, dst, frameStep, maxColors); err != nil {
+			return "", err
+		}
+
+		if config.OptimizeGifTargetBytes <= 0 || optimizedSize <= int64(config.OptimizeGifTargetBytes) {
+			break
+		}
+		if !tightenGifOptimization(&frameStep, &maxColors) {
+			logWarnf("couldn't optimize replay '%s' below %d bytes", replayFilePath, config.OptimizeGifTargetBytes)
+			break
+		}
+	}
+
+	if optimizedSize >= originalInfo.Size() {
+		logInfof("Optimizing replay '%s' wouldn't make it smaller (%d bytes -> %d bytes), keeping the original", replayFilePath, originalInfo.Size(), optimizedSize)
+		return "", nil
+	}
+
+	logInfof("Optimized replay '%s': %d bytes -> %d bytes", replayFilePath, originalInfo.Size(), optimizedSize)
+	keep = true
+	return dst.Name(), nil
+}
+
+// optimizeGifToFile replaces the contents of dst with an optimized copy of src, and returns its size.
+func optimizeGifToFile(src *os.File, dst *os.File, frameStep int, maxColors int) (int64, error) {
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	if _, err := dst.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	if err := dst.Truncate(0); err != nil {
+		return 0, err
+	}
+
+	if err := optimizeGif(src, dst, frameStep, maxColors); err != nil {
+		return 0, err
+	}
+
+	if info, err := dst.Stat(); err != nil {
+		return 0, err
+	} else {
+		return info.Size(), nil
+	}
+}
+
+// tightenGifOptimization makes the optimization settings one step more aggressive, returning false if
+// they already are as aggressive as they go.
+func tightenGifOptimization(frameStep *int, maxColors *int) bool {
+	if *maxColors <= 0 || *maxColors > 256 {
+		*maxColors = 256
+	}
+	if *maxColors > OPTIMIZE_GIF_MIN_COLORS {
+		*maxColors /= 2
+		if *maxColors < OPTIMIZE_GIF_MIN_COLORS {
+			*maxColors = OPTIMIZE_GIF_MIN_COLORS
+		}
+		return true
+	}
+
+	if *frameStep < 1 {
+		*frameStep = 1
+	}
+	if *frameStep < OPTIMIZE_GIF_MAX_FRAME_STEP {
+		*frameStep++
+		return true
+	}
+
+	return false
+}
+
+// optimizeGif re-encodes a GIF keeping only every frameStep'th frame and at most maxColors palette
+// entries per frame. A frameStep <= 1 keeps every frame and a maxColors <= 0 keeps the palettes as-is.
+func optimizeGif(src io.Reader, dst io.Writer, frameStep int, maxColors int) error {
+	decoded, err := gif.DecodeAll(src)
+	if err != nil {
+		return err
+	}
+
+	if frameStep < 1 {
+		frameStep = 1
+	}
+
+	bounds := image.Rect(0, 0, decoded.Config.Width, decoded.Config.Height)
+	canvas := image.NewRGBA(bounds)
+	optimized := &gif.GIF{
+		LoopCount: decoded.LoopCount,
+		Config:    image.Config{Width: decoded.Config.Width, Height: decoded.Config.Height},
+	}
+
+	for frameIdx, frame := range decoded.Image {
+		disposal := byte(gif.DisposalNone)
+		if frameIdx < len(decoded.Disposal) {
+			disposal = decoded.Disposal[frameIdx]
+		}
+
+		var previous *image.RGBA
+		if disposal == gif.DisposalPrevious {
+			previous = image.NewRGBA(bounds)
+			draw.Draw(previous, bounds, canvas, bounds.Min, draw.Src)
+		}
+
+		// frames may only cover part of the image, so composite them before dropping any
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+
+		if frameIdx%frameStep == 0 {
+			paletted := image.NewPaletted(bounds, reducePalette(frame.Palette, maxColors))
+			draw.Draw(paletted, bounds, canvas, bounds.Min, draw.Src)
+
+			optimized.Image = append(optimized.Image, paletted)
+			optimized.Delay = append(optimized.Delay, decoded.Delay[frameIdx])
+			optimized.Disposal = append(optimized.Disposal, gif.DisposalNone)
+		} else {
+			// the kept frame is shown for as long as the frames it replaces
+			optimized.Delay[len(optimized.Delay)-1] += decoded.Delay[frameIdx]
+		}
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+
+	return gif.EncodeAll(dst, optimized)
+}
+
+func reducePalette(palette color.Palette, maxColors int) color.Palette {
+	if maxColors <= 0 || len(palette) <= maxColors {
+		return palette
+	}
+
+	reduced := make(color.Palette, maxColors)
+	for i := range reduced {
+		reduced[i] = palette[i*len(palette)/maxColors]
+	}
+
+	return reduced
+}
+
+// renderThumbnail decodes the first frame of the replay GIF and returns it encoded as a PNG.
+func renderThumbnail(replayFilePath string) ([]byte, error) {
+	fh, err := os.Open(replayFilePath)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	firstFrame, err := gif.Decode(fh)
+	if err != nil {
+		return nil, err
+	}
+
+	pngBuf := &bytes.Buffer{}
+	if err := png.Encode(pngBuf, firstFrame); err != nil {
+		return nil, err
+	}
+
+	return pngBuf.Bytes(), nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// replayMetadata returns the values available to the message and file name templates for a replay:
+//
+//	{filename} the replay's file name, e.g. "replay_1700000000.gif"
+//	{basename} the file name without its extension, e.g. "replay_1700000000"
+//	{ext}      the file extension, e.g. ".gif"
+//	{index}    the replay's position among all posted replays, starting at 1
+//	{date}     the replay's modification date, e.g. "2024-01-15"
+//
+// along with the named capture groups of the configured FilenameMetadataPattern, which take precedence.
+// The second return value reports whether the pattern matched.
+func replayMetadata(replayFilePath string, replayIndex int, config *Config) (map[string]string, bool) {
+	replayFileName := filepath.Base(replayFilePath)
+	metadata := map[string]string{
+		"filename": replayFileName,
+		"basename": strings.TrimSuffix(replayFileName, filepath.Ext(replayFileName)),
+		"ext":      filepath.Ext(replayFileName),
+		"index":    strconv.Itoa(replayIndex),
+	}
+
+	if info, err := os.Stat(replayFilePath); err == nil {
+		metadata["date"] = info.ModTime().Format("2006-01-02")
+	}
+
+	if config.filenameMetadataRegexp == nil {
+		return metadata, false
+	}
+
+	match := config.filenameMetadataRegexp.FindStringSubmatch(replayFileName)
+	if match == nil {
+		return metadata, false
+	}
+
+	for groupIdx, groupName := range config.filenameMetadataRegexp.SubexpNames() {
+		if groupName != "" {
+			metadata[groupName] = match[groupIdx]
+		}
+	}
+
+	return metadata, true
+}
+
+// renderReplayTemplate renders a template with a replay's metadata, falling back to the bare file name
+// when a FilenameMetadataPattern is configured but didn't match.
+func renderReplayTemplate(template string, metadata map[string]string, matched bool, config *Config) string {
+	if config.filenameMetadataRegexp != nil && !matched {
+		return metadata["filename"]
+	}
+
+	return renderTemplate(template, metadata)
+}
+
+// renderTemplate replaces each {name} placeholder in template with the corresponding value.
+// Placeholders without a value are left as-is.
+func renderTemplate(template string, values map[string]string) string {
+	replacements := make([]string, 0, len(values)*2)
+	for name, value := range values {
+		replacements = append(replacements, "{"+name+"}", value)
+	}
+
+	return strings.NewReplacer(replacements...).Replace(template)
+}
+
+// renderMatchComment describes a replay's match from the "players", "stage" and "date" groups captured
+// by FilenameMetadataPattern, e.g. "Players: alice-vs-bob | Stage: sacred_ground". It returns "" when
+// none of them were captured.
+func renderMatchComment(metadata map[string]string, matched bool, config *Config) string {
+	if !matched {
+		return ""
+	}
+
+	captured := make(map[string]bool)
+	for _, groupName := range config.filenameMetadataRegexp.SubexpNames() {
+		captured[groupName] = true
+	}
+
+	parts := make([]string, 0, 3)
+	for _, field := range []struct{ group, label string }{{"players", "Players"}, {"stage", "Stage"}, {"date", "Date"}} {
+		if captured[field.group] && metadata[field.group] != "" {
+			parts = append(parts, field.label+": "+metadata[field.group])
+		}
+	}
+
+	return strings.Join(parts, " | ")
+}
+
+// renderFileDate describes when a replay was written, going by its modification time, in FileDateLayout
+// and FileDateTimeZone, e.g. "Recorded 2024-03-01 21:15 CET".
+func renderFileDate(modTime time.Time, config *Config) string {
+	location := config.fileDateLocation
+	if location == nil {
+		location = time.Local
+	}
+
+	return "Recorded " + modTime.In(location).Format(config.FileDateLayout)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const DEFAULT_S3_REGION string = "us-east-1"
+const S3_UNSIGNED_PAYLOAD string = "UNSIGNED-PAYLOAD"
+const DEFAULT_S3_TIMEOUT_SECONDS int = 120
+
+// archiveReplayToS3 copies an uploaded replay into the configured S3-compatible bucket and returns the
+// object key it was stored under. It gives up after S3TimeoutSeconds, so that an unresponsive endpoint
+// can't hold up posting the replays after it.
+func archiveReplayToS3(replayFilePath string, config *Config) (string, error) {
+	objectKey := s3ObjectKey(filepath.Base(replayFilePath), time.Now(), config)
+
+	fh, err := os.Open(replayFilePath)
+	if err != nil {
+		return "", err
+	}
+	defer fh.Close()
+
+	info, err := fh.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	objectUrl, err := url.Parse(strings.TrimRight(s3Endpoint(config), "/") + "/" + s3EscapePath(config.S3Bucket+"/"+objectKey))
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.S3TimeoutSeconds)*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, objectUrl.String(), fh)
+	if err != nil {
+		return "", err
+	}
+	req.ContentLength = info.Size()
+	req.Header.Set("Content-Type", "image/gif")
+	signS3Request(req, s3Region(config), s3Credentials(config), time.Now().UTC())
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return "", errors.New(fmt.Sprintf("Error archiving replay '%s' to S3: %d %s", replayFilePath, resp.StatusCode, body))
+	}
+
+	return objectKey, nil
+}
+
+func s3ObjectKey(replayFileName string, archivedAt time.Time, config *Config) string {
+	objectKey := replayFileName
+	if config.S3DatePrefix {
+		objectKey = archivedAt.Format("2006/01/02") + "/" + objectKey
+	}
+
+	if config.S3KeyPrefix != "" {
+		objectKey = strings.TrimRight(config.S3KeyPrefix, "/") + "/" + objectKey
+	}
+
+	return objectKey
+}
+
+type S3Credentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// s3Credentials returns the configured S3 credentials, falling back to the standard AWS environment
+// variables when none are configured.
+func s3Credentials(config *Config) S3Credentials {
+	if config.S3AccessKeyID != "" {
+		return S3Credentials{AccessKeyID: config.S3AccessKeyID, SecretAccessKey: config.S3SecretAccessKey}
+	}
+
+	return S3Credentials{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+}
+
+func s3Region(config *Config) string {
+	if config.S3Region != "" {
+		return config.S3Region
+	}
+
+	for _, envVar := range []string{"AWS_REGION", "AWS_DEFAULT_REGION"} {
+		if region := os.Getenv(envVar); region != "" {
+			return region
+		}
+	}
+
+	return DEFAULT_S3_REGION
+}
+
+func s3Endpoint(config *Config) string {
+	if config.S3Endpoint == "" {
+		return fmt.Sprintf("https://s3.%s.amazonaws.com", s3Region(config))
+	}
+
+	return config.S3Endpoint
+}
+
+// signS3Request adds an AWS Signature Version 4 Authorization header to req. The payload is left
+// unsigned so that the replay can be streamed from disk rather than hashed up front.
+func signS3Request(req *http.Request, region string, credentials S3Credentials, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	shortDate := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", S3_UNSIGNED_PAYLOAD)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + S3_UNSIGNED_PAYLOAD + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+
+	// temporary credentials carry a session token, which has to be signed too
+	if credentials.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", credentials.SessionToken)
+		signedHeaders += ";x-amz-security-token"
+		canonicalHeaders += "x-amz-security-token:" + credentials.SessionToken + "\n"
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		S3_UNSIGNED_PAYLOAD,
+	}, "\n")
+
+	scope := shortDate + "/" + region + "/s3/aws4_request"
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalRequestHash[:])
+
+	signingKey := hmacSha256([]byte("AWS4"+credentials.SecretAccessKey), shortDate)
+	signingKey = hmacSha256(signingKey, region)
+	signingKey = hmacSha256(signingKey, "s3")
+	signingKey = hmacSha256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSha256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		credentials.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3EscapePath URI-encodes every character of an object path except the unreserved ones and '/', as
+// required by Signature Version 4.
+func s3EscapePath(objectPath string) string {
+	var escaped strings.Builder
+	for _, b := range []byte(objectPath) {
+		if ('A' <= b && b <= 'Z') || ('a' <= b && b <= 'z') || ('0' <= b && b <= '9') ||
+			b == '-' || b == '_' || b == '.' || b == '~' || b == '/' {
+			escaped.WriteByte(b)
+		} else {
+			fmt.Fprintf(&escaped, "%%%02X", b)
+		}
+	}
+
+	return escaped.String()
+}
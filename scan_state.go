@@ -0,0 +1,260 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ScanState holds what the watcher remembers about the replay directory between scans.
+type ScanState struct {
+	clock     Clock
+	debouncer *Debouncer
+	bundler   *Bundler
+	status    *ScanStatus
+	inFlight  *InFlightSet
+
+	uploadLimiter *UploadLimiter
+	digest        *DigestScheduler
+
+	replayDirectoryMissing bool
+}
+
+func newScanState() *ScanState {
+	return newScanStateWithClock(RealClock{})
+}
+
+func newScanStateWithClock(clock Clock) *ScanState {
+	return &ScanState{clock: clock, debouncer: newDebouncer(clock), bundler: newBundler(clock), status: &ScanStatus{clock: clock}, inFlight: newInFlightSet(),
+		uploadLimiter: &UploadLimiter{clock: clock}, digest: &DigestScheduler{lastDigest: clock.Now()}}
+}
+
+type debounceEntry struct {
+	size      int64
+	modTime   time.Time
+	changedAt time.Time
+}
+
+// Debouncer tracks, per path, when a file was last seen to change so that it is only considered once
+// it has been quiet for the debounce window.
+type Debouncer struct {
+	clock   Clock
+	entries map[string]debounceEntry
+}
+
+func newDebouncer(clock Clock) *Debouncer {
+	return &Debouncer{clock: clock, entries: make(map[string]debounceEntry)}
+}
+
+// settled reports whether the file at filePath has gone unchanged for at least window. A file seen
+// for the first time is considered to have last changed at its modification time.
+func (d *Debouncer) settled(filePath string, window time.Duration) (bool, error) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return false, err
+	}
+
+	now := d.clock.Now()
+	entry, seen := d.entries[filePath]
+
+	if !seen {
+		entry = debounceEntry{size: info.Size(), modTime: info.ModTime(), changedAt: info.ModTime()}
+	} else if entry.size != info.Size() || !entry.modTime.Equal(info.ModTime()) {
+		entry = debounceEntry{size: info.Size(), modTime: info.ModTime(), changedAt: now}
+	}
+	d.entries[filePath] = entry
+
+	return now.Sub(entry.changedAt) >= window, nil
+}
+
+// sizeStable reports whether the file at filePath has the same size as when the previous scan saw it,
+// ignoring its modification time. A file seen for the first time is never stable, so it takes at least
+// two scans to be uploaded.
+func (d *Debouncer) sizeStable(filePath string) (bool, error) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return false, err
+	}
+
+	entry, seen := d.entries[filePath]
+	stable := seen && entry.size == info.Size()
+	d.entries[filePath] = debounceEntry{size: info.Size(), modTime: info.ModTime(), changedAt: d.clock.Now()}
+
+	return stable, nil
+}
+
+// prune forgets every path not in currentPaths.
+func (d *Debouncer) prune(currentPaths []string) {
+	current := make(map[string]bool, len(currentPaths))
+	for _, currentPath := range currentPaths {
+		current[currentPath] = true
+	}
+
+	for filePath := range d.entries {
+		if !current[filePath] {
+			delete(d.entries, filePath)
+		}
+	}
+}
+
+// Bundler holds pending replays back until no new ones have turned up for the bundle window, so that a
+// burst of replays is posted together.
+type Bundler struct {
+	clock       Clock
+	known       map[string]bool
+	lastArrival time.Time
+}
+
+func newBundler(clock Clock) *Bundler {
+	return &Bundler{clock: clock, known: make(map[string]bool)}
+}
+
+// ready reports whether the pending replays have gone at least window without a new one arriving.
+func (b *Bundler) ready(pendingPaths []string, window time.Duration) bool {
+	now := b.clock.Now()
+	current := make(map[string]bool, len(pendingPaths))
+
+	for _, pendingPath := range pendingPaths {
+		current[pendingPath] = true
+		if !b.known[pendingPath] {
+			b.lastArrival = now
+		}
+	}
+	b.known = current
+
+	return now.Sub(b.lastArrival) >= window
+}
+
+// DigestScheduler decides when the replays held back in DigestMode are due to be posted: at the first
+// scan after DigestTime each day, or once DigestIdleMinutes have passed without a new replay. Once a
+// digest is due it stays due until every held-back replay has been posted.
+type DigestScheduler struct {
+	lastDigest time.Time
+	posting    bool
+}
+
+// due reports whether the digest of the pending replays should be posted now.
+func (d *DigestScheduler) due(now time.Time, pendingPaths []string, config *Config) bool {
+	if d.posting {
+		return true
+	}
+
+	if config.DigestTime != "" {
+		scheduled := time.Date(now.Year(), now.Month(), now.Day(), config.digestTime.Hour(), config.digestTime.Minute(), 0, 0, now.Location())
+		if now.Before(scheduled) {
+			scheduled = scheduled.AddDate(0, 0, -1)
+		}
+		if d.lastDigest.Before(scheduled) {
+			d.posting = true
+		}
+	}
+
+	if config.DigestIdleMinutes > 0 {
+		var newest time.Time
+		for _, pendingPath := range pendingPaths {
+			if info, err := os.Stat(pendingPath); err == nil && info.ModTime().After(newest) {
+				newest = info.ModTime()
+			}
+		}
+		if now.Sub(newest) >= time.Duration(config.DigestIdleMinutes)*time.Minute {
+			d.posting = true
+		}
+	}
+
+	return d.posting
+}
+
+// posted records that every held-back replay has been posted.
+func (d *DigestScheduler) posted(now time.Time) {
+	d.lastDigest = now
+	d.posting = false
+}
+
+// InFlightSet tracks the replays currently being processed, so that the same file is never processed
+// twice at once even if it turns up under two paths (e.g. through a symlink).
+type InFlightSet struct {
+	mutex sync.Mutex
+	paths map[string]bool
+}
+
+func newInFlightSet() *InFlightSet {
+	return &InFlightSet{paths: make(map[string]bool)}
+}
+
+// add marks filePath as in flight, returning false if it already was.
+func (s *InFlightSet) add(filePath string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := inFlightKey(filePath)
+	if s.paths[key] {
+		return false
+	}
+	s.paths[key] = true
+
+	return true
+}
+
+func (s *InFlightSet) remove(filePath string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.paths, inFlightKey(filePath))
+}
+
+func inFlightKey(filePath string) string {
+	if resolved, err := filepath.EvalSymlinks(filePath); err == nil {
+		return resolved
+	}
+
+	return filePath
+}
+
+// UploadLimiter caps how many replays are uploaded per scan and per minute, so that a large backlog
+// trickles into the channel over several scans instead of all at once. The per-minute limit is a token
+// bucket holding up to UploadsPerMinute uploads, refilled at UploadsPerMinute per minute.
+type UploadLimiter struct {
+	clock      Clock
+	tokens     float64
+	lastRefill time.Time
+}
+
+// allowed returns how many replays may be uploaded in this scan, or -1 if there's no limit.
+func (l *UploadLimiter) allowed(config *Config) int {
+	allowed := -1
+	if config.MaxUploadsPerCycle > 0 {
+		allowed = config.MaxUploadsPerCycle
+	}
+
+	if config.UploadsPerMinute > 0 {
+		l.refill(config.UploadsPerMinute)
+
+		if available := int(l.tokens); allowed < 0 || available < allowed {
+			allowed = available
+		}
+	}
+
+	return allowed
+}
+
+// recordUpload takes a token from the bucket for an upload attempt.
+func (l *UploadLimiter) recordUpload() {
+	if l.tokens >= 1 {
+		l.tokens--
+	}
+}
+
+func (l *UploadLimiter) refill(uploadsPerMinute int) {
+	now := l.clock.Now()
+	if l.lastRefill.IsZero() {
+		l.tokens = float64(uploadsPerMinute)
+	} else {
+		l.tokens += now.Sub(l.lastRefill).Minutes() * float64(uploadsPerMinute)
+	}
+	l.lastRefill = now
+
+	if l.tokens > float64(uploadsPerMinute) {
+		l.tokens = float64(uploadsPerMinute)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The scope a token needs to post replays.
+const SLACK_FILES_WRITE_SCOPE string = "files:write"
+
+const AUTH_CHECK_TIMEOUT_SECONDS time.Duration = time.Duration(30)
+
+type AuthTestResponseBody struct {
+	Ok     bool
+	Error  string
+	Team   string
+	TeamId string `json:"team_id"`
+	User   string
+	UserId string `json:"user_id"`
+	BotId  string `json:"bot_id"`
+}
+
+// checkTargetAuth checks the configured credentials before any replay is uploaded. Only Slack tokens are
+// checked for now.
+func checkTargetAuth(config *Config) error {
+	if config.Target != TARGET_SLACK {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), AUTH_CHECK_TIMEOUT_SECONDS*time.Second)
+	defer cancel()
+
+	return checkSlackAuth(ctx, config)
+}
+
+// checkSlackAuth calls auth.test with AuthToken, so that a revoked or mistyped token, or one without the
+// files:write scope, stops the uploader at startup rather than failing the first upload. A token Slack
+// rejects is a *ConfigError; failing to reach Slack isn't, since it may well work on the next start.
+func checkSlackAuth(ctx context.Context, config *Config) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, slackApiUrl("auth.test", config), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+config.AuthToken)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Error calling auth.test: %s", err))
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(fmt.Sprintf("Error calling auth.test: %d", resp.StatusCode))
+	}
+
+	var responseBody AuthTestResponseBody
+	if err := json.NewDecoder(resp.Body).Decode(&responseBody); err != nil {
+		return errors.New(fmt.Sprintf("Error decoding the auth.test response: %s", err))
+	} else if !responseBody.Ok {
+		return &ConfigError{errors.New(fmt.Sprintf("AuthToken was rejected by auth.test: %s", responseBody.Error))}
+	}
+
+	if responseBody.BotId != "" {
+		logInfof("Authenticated to Slack team '%s' (%s) as bot user '%s' (%s, bot %s)", responseBody.Team, responseBody.TeamId,
+			responseBody.User, responseBody.UserId, responseBody.BotId)
+	} else {
+		logInfof("Authenticated to Slack team '%s' (%s) as user '%s' (%s)", responseBody.Team, responseBody.TeamId,
+			responseBody.User, responseBody.UserId)
+	}
+
+	// Slack lists the token's scopes in a header; older token types don't send it, so only check when it's there
+	if scopes := resp.Header.Get("X-OAuth-Scopes"); scopes != "" {
+		for _, scope := range strings.Split(scopes, ",") {
+			if strings.TrimSpace(scope) == SLACK_FILES_WRITE_SCOPE {
+				return nil
+			}
+		}
+		return &ConfigError{errors.New(fmt.Sprintf("AuthToken is missing the %s scope, it has: %s", SLACK_FILES_WRITE_SCOPE, scopes))}
+	}
+
+	return nil
+}
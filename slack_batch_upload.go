@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+)
+
+// The most replays posted together in one message with BatchUpload; larger scans are split into several
+// messages.
+const BATCH_UPLOAD_MAX_FILES int = 10
+
+// uploadReplaysInBatches posts the pending replays of a scan in messages of up to BATCH_UPLOAD_MAX_FILES
+// replays each, threading the later messages under the first with BundleThread or DigestMode.
+func uploadReplaysInBatches(ctx context.Context, replayPaths []string, db *sql.DB, config *Config, state *ScanState) error {
+	batch := make([]string, 0, len(replayPaths))
+	processed := make(map[string]bool)
+	for _, replayFilePath := range replayPaths {
+		if processed[inFlightKey(replayFilePath)] {
+			logDebugf("Replay '%s' was already processed in this scan, skipping it", replayFilePath)
+			continue
+		}
+		processed[inFlightKey(replayFilePath)] = true
+
+		if !state.inFlight.add(replayFilePath) {
+			logDebugf("Replay '%s' is already being uploaded, skipping it", replayFilePath)
+			continue
+		}
+		defer state.inFlight.remove(replayFilePath)
+
+		batch = append(batch, replayFilePath)
+	}
+
+	threadTs := ""
+	var failures []*UploadError
+	for start := 0; start < len(batch); start += BATCH_UPLOAD_MAX_FILES {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		end := start + BATCH_UPLOAD_MAX_FILES
+		if end > len(batch) {
+			end = len(batch)
+		}
+
+		ts, err := uploadAndRecordReplayBatch(ctx, batch[start:end], threadTs, db, config)
+		for range batch[start:end] {
+			state.uploadLimiter.recordUpload()
+		}
+
+		if err != nil && !continueAfterUploadError(err, &failures, config) {
+			return err
+		} else if (config.BundleThread || config.DigestMode) && threadTs == "" {
+			threadTs = ts
+		}
+	}
+
+	return uploadFailuresError(failures)
+}
+
+// uploadAndRecordReplayBatch sends the bytes of each replay with the external upload flow, then shares
+// them all in a single message, and records each replay as uploaded. Replays whose bytes couldn't be
+// sent are dealt with like any failed upload, and the rest are still posted. It returns the message's
+// timestamp.
+func uploadAndRecordReplayBatch(ctx context.Context, replayFilePaths []string, threadTs string, db *sql.DB, config *Config) (string, error) {
+	uploadedCount, err := countUploadedReplays(db)
+	if err != nil {
+		return "", &DatabaseError{err}
+	}
+
+	var failure error
+	sentPaths := make([]string, 0, len(replayFilePaths))
+	uploads := make([]*ReplayUpload, 0, len(replayFilePaths))
+	fileIds := make([]string, 0, len(replayFilePaths))
+	for _, replayFilePath := range replayFilePaths {
+		if err := enqueueReplay(filepath.Base(replayFilePath), db); err != nil {
+			return "", &DatabaseError{err}
+		}
+
+		upload, cleanup := prepareReplayUpload(replayFilePath, threadTs, uploadedCount+len(uploads)+1, config)
+		logInfof("Uploading replay '%s'", upload.FilePath)
+		fileId, err := sendOrResumeReplayExternal(ctx, upload, db, config)
+		cleanup()
+
+		if err != nil {
+			if err := handleReplayUploadFailure(ctx, replayFilePath, err, db, config); err != nil && failure == nil {
+				failure = err
+			}
+			continue
+		}
+
+		sentPaths = append(sentPaths, replayFilePath)
+		uploads = append(uploads, upload)
+		fileIds = append(fileIds, fileId)
+	}
+
+	if len(uploads) == 0 {
+		return "", failure
+	}
+
+	var responseBody *ResponseBody
+	err = retryAfterJoiningChannel(ctx, config, func() (err error) {
+		responseBody, err = completeUploadsExternal(ctx, fileIds, uploads, config)
+		return err
+	})
+	if err != nil {
+		for i, replayFilePath := range sentPaths {
+			if externalFileGone(err) {
+				if err := clearExternalFileId(uploads[i].ReplayName, config.ChannelID, db); err != nil {
+					logErrorf("%s", err)
+				}
+			}
+
+			if err := handleReplayUploadFailure(ctx, replayFilePath, err, db, config); err != nil && failure == nil {
+				failure = err
+			}
+		}
+		return "", failure
+	}
+	logInfof("Posted %d replay(s) in one message", len(uploads))
+
+	for i, replayFilePath := range sentPaths {
+		if err := clearExternalFileId(uploads[i].ReplayName, config.ChannelID, db); err != nil {
+			logErrorf("%s", err)
+		}
+
+		if err := recordReplayUploaded(replayFilePath, fileIds[i], db, config); err != nil {
+			return "", err
+		}
+	}
+
+	return responseBody.shareTs(config.ChannelID), failure
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+)
+
+const MESSAGE_FORMAT_FILE string = "file"
+const MESSAGE_FORMAT_BLOCKS string = "blocks"
+
+// The Block Kit message posted for each replay when MessageFormat is "blocks": the replay as an image,
+// followed by the message. Placeholders are substituted as JSON string contents.
+const DEFAULT_BLOCKS_TEMPLATE string = `[
+	{"type": "image", "slack_file": {"id": "{file_id}"}, "alt_text": "{filename}", "title": {"type": "plain_text", "text": "{title}"}},
+	{"type": "context", "elements": [{"type": "mrkdwn", "text": "{message}"}]}
+]`
+
+type PostMessageResponseBody struct {
+	Ok       bool
+	Error    string
+	Warning  string
+	Needed   string
+	Provided string
+	Ts       string
+}
+
+// postReplayBlocks posts the Block Kit message for a replay that was uploaded without being shared, and
+// returns the message's timestamp. Along with the replay's metadata, the blocks template can use:
+//
+//	{file_id}     the id of the uploaded file
+//	{permalink}   the file's permalink
+//	{url_private} the file's private download URL
+//	{title}       the name the file was uploaded under
+//	{message}     the MessageTemplate message and match comment, or the title if there are none
+func postReplayBlocks(ctx context.Context, upload *ReplayUpload, file ResponseFile, config *Config) (string, error) {
+	text := upload.InitialComment
+	if text == "" {
+		text = upload.FileName
+	}
+
+	values := make(map[string]string, len(upload.Metadata)+5)
+	for name, value := range upload.Metadata {
+		values[name] = value
+	}
+	values["file_id"] = file.Id
+	values["permalink"] = file.Permalink
+	values["url_private"] = file.UrlPrivate
+	values["title"] = upload.FileName
+	if upload.Title != "" {
+		values["title"] = upload.Title
+	}
+	values["message"] = text
+
+	params := url.Values{}
+	params.Set("channel", config.ChannelID)
+	params.Set("blocks", renderBlocksTemplate(config.BlocksTemplate, values))
+	params.Set("text", text)
+	if upload.ThreadTs != "" {
+		params.Set("thread_ts", upload.ThreadTs)
+	}
+
+	var responseBody PostMessageResponseBody
+	if err := callSlackApi(ctx, "chat.postMessage", params, &responseBody, config); err != nil {
+		return "", err
+	}
+	if responseBody.Warning != "" {
+		logWarnf("Slack responded with warning '%s'", responseBody.Warning)
+	}
+
+	if !responseBody.Ok {
+		return "", &SlackApiError{responseBody.Error, errors.New(fmt.Sprintf("Error posting the message for replay '%s': %s", upload.ReplayName,
+			slackErrorDetail(responseBody.Error, responseBody.Needed, responseBody.Provided)))}
+	}
+
+	return responseBody.Ts, nil
+}
+
+// renderBlocksTemplate renders a blocks template, escaping each value so that it can't break out of the
+// JSON string it's substituted into.
+func renderBlocksTemplate(template string, values map[string]string) string {
+	escaped := make(map[string]string, len(values))
+	for name, value := range values {
+		quoted, _ := json.Marshal(value)
+		escaped[name] = string(quoted[1 : len(quoted)-1])
+	}
+
+	return renderTemplate(template, escaped)
+}
+
+// validateBlocksTemplate checks that a blocks template renders to a JSON array of blocks.
+func validateBlocksTemplate(template string) error {
+	var blocks []map[string]interface{}
+	if err := json.Unmarshal([]byte(renderBlocksTemplate(template, map[string]string{})), &blocks); err != nil {
+		return errors.New(fmt.Sprintf("Invalid BlocksTemplate: must be a JSON array of blocks: %s", err))
+	}
+
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+)
+
+// The error Slack answers with when the token's user isn't a member of the channel.
+const SLACK_ERROR_NOT_IN_CHANNEL string = "not_in_channel"
+
+type JoinResponseBody struct {
+	Ok       bool
+	Error    string
+	Needed   string
+	Provided string
+}
+
+// notInChannel reports whether err is Slack refusing a request because the uploader isn't a member of
+// the channel.
+func notInChannel(err error) bool {
+	var apiErr *SlackApiError
+	return errors.As(err, &apiErr) && apiErr.Code == SLACK_ERROR_NOT_IN_CHANNEL
+}
+
+// retryAfterJoiningChannel runs post, and if Slack refuses it because the uploader isn't in the channel,
+// joins the channel and runs it once more when AutoJoinChannel is set.
+func retryAfterJoiningChannel(ctx context.Context, config *Config, post func() error) error {
+	err := post()
+	if !notInChannel(err) {
+		return err
+	}
+
+	if !config.AutoJoinChannel {
+		return errors.New(fmt.Sprintf("%s: invite the uploader to channel '%s', or set AutoJoinChannel to have it join public channels itself", err, config.ChannelID))
+	}
+
+	logInfof("Not a member of channel '%s', joining it", config.ChannelID)
+	if err := joinSlackChannel(ctx, config); err != nil {
+		return err
+	}
+
+	return post()
+}
+
+// joinSlackChannel joins the configured channel with conversations.join. Only public channels can be
+// joined this way; the uploader has to be invited to private ones.
+func joinSlackChannel(ctx context.Context, config *Config) error {
+	params := url.Values{}
+	params.Set("channel", config.ChannelID)
+
+	var responseBody JoinResponseBody
+	if err := callSlackApi(ctx, "conversations.join", params, &responseBody, config); err != nil {
+		return err
+	}
+
+	if !responseBody.Ok {
+		return errors.New(fmt.Sprintf("Error joining channel '%s': %s; if it's a private channel, invite the uploader to it with /invite",
+			config.ChannelID, slackErrorDetail(responseBody.Error, responseBody.Needed, responseBody.Provided)))
+	}
+
+	return nil
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Chunked external uploads record the upload URL and the last offset it confirmed after every chunk, so
+// that an upload interrupted part way through a large replay resumes from there rather than from the
+// first byte.
+const CREATE_EXTERNAL_UPLOAD_PROGRESS_SQL string = `CREATE TABLE IF NOT EXISTS external_upload_progress(
+	replay_file_name varchar(512) PRIMARY KEY,
+	upload_url text NOT NULL,
+	file_id text NOT NULL,
+	total_bytes integer NOT NULL,
+	confirmed_bytes integer NOT NULL,
+	updated_at integer NOT NULL
+);`
+
+// Rebuilds external_upload_progress keyed by replay and channel, so that an upload URL reserved for one
+// channel is never resumed for another after ChannelID changes.
+const CREATE_EXTERNAL_UPLOAD_PROGRESS_BY_CHANNEL_SQL string = `CREATE TABLE external_upload_progress_by_channel(
+	replay_file_name text NOT NULL,
+	channel_id varchar(64) NOT NULL,
+	upload_url text NOT NULL,
+	file_id text NOT NULL,
+	total_bytes integer NOT NULL,
+	confirmed_bytes integer NOT NULL,
+	updated_at integer NOT NULL,
+	PRIMARY KEY(replay_file_name, channel_id)
+);`
+
+// How many times in a row a chunk is retried before the upload is given up until the next scan.
+const EXTERNAL_UPLOAD_CHUNK_RETRIES int = 3
+
+// errChunkedUploadUnsupported is an upload URL answering a chunk or an offset query with a 200 rather than
+// a 308, as if it had every byte. Slack's own upload URLs do this, so nothing it confirmed can be trusted.
+var errChunkedUploadUnsupported = errors.New("upload URL does not support chunked uploads; unset ExternalUploadChunkBytes")
+
+type ExternalUploadProgress struct {
+	UploadUrl      string
+	FileId         string
+	TotalBytes     int64
+	ConfirmedBytes int64
+}
+
+// sendReplayChunksExternal sends a replay's bytes to an upload URL in chunks of ExternalUploadChunkBytes,
+// using Content-Range requests. The upload URL answers each chunk with 308 and the range it has
+// received so far, which lets a dropped chunk be resent from the last confirmed offset. If it answers
+// with a 200 before the last chunk, errChunkedUploadUnsupported is returned straight away and the
+// progress recorded so far is dropped.
+func sendReplayChunksExternal(ctx context.Context, upload *ReplayUpload, fh *os.File, size int64, db *sql.DB, config *Config) (string, error) {
+	progress, err := storedExternalUploadProgress(upload.ReplayName, config.ChannelID, db)
+	if err != nil {
+		return "", err
+	}
+
+	if progress != nil && progress.TotalBytes != size {
+		logWarnf("replay '%s' changed size since its upload started, starting over", upload.FilePath)
+		progress = nil
+	}
+
+	if progress != nil {
+		if progress.ConfirmedBytes, err = queryUploadOffset(ctx, progress); err != nil {
+			logWarnf("can't resume the upload of replay '%s', starting over: %s", upload.FilePath, err)
+			progress = nil
+		} else {
+			logInfof("Resuming the upload of replay '%s' from byte %d of %d", upload.FilePath, progress.ConfirmedBytes, size)
+		}
+	}
+
+	if progress == nil {
+		uploadUrlResponse, err := reserveUploadUrlExternal(ctx, upload, size, config)
+		if err != nil {
+			return "", err
+		}
+
+		progress = &ExternalUploadProgress{UploadUrl: uploadUrlResponse.UploadUrl, FileId: uploadUrlResponse.FileId, TotalBytes: size}
+	}
+
+	if err := storeExternalUploadProgress(upload.ReplayName, config.ChannelID, progress, db); err != nil {
+		return "", err
+	}
+
+	for failures := 0; progress.ConfirmedBytes < size; {
+		end := progress.ConfirmedBytes + int64(config.ExternalUploadChunkBytes)
+		if end > size {
+			end = size
+		}
+
+		confirmed, err := sendReplayChunk(ctx, fh, progress, end)
+		if err == nil && confirmed <= progress.ConfirmedBytes {
+			err = errors.New(fmt.Sprintf("upload URL confirmed no new bytes after byte %d", progress.ConfirmedBytes))
+		}
+
+		if errors.Is(err, errChunkedUploadUnsupported) {
+			if err := clearExternalUploadProgress(upload.ReplayName, config.ChannelID, db); err != nil {
+				logErrorf("%s", err)
+			}
+			return "", err
+		} else if err != nil {
+			failures++
+			if failures > EXTERNAL_UPLOAD_CHUNK_RETRIES || ctx.Err() != nil {
+				return "", errors.New(fmt.Sprintf("Error uploading replay '%s' at byte %d of %d: %s", upload.FilePath, progress.ConfirmedBytes, size, err))
+			}
+
+			logWarnf("error uploading replay '%s' at byte %d of %d, resuming: %s", upload.FilePath, progress.ConfirmedBytes, size, err)
+			if confirmed, err = queryUploadOffset(ctx, progress); errors.Is(err, errChunkedUploadUnsupported) {
+				if err := clearExternalUploadProgress(upload.ReplayName, config.ChannelID, db); err != nil {
+					logErrorf("%s", err)
+				}
+				return "", err
+			} else if err != nil {
+				return "", errors.New(fmt.Sprintf("Error resuming the upload of replay '%s': %s", upload.FilePath, err))
+			}
+		} else {
+			failures = 0
+		}
+
+		progress.ConfirmedBytes = confirmed
+		if err := storeExternalUploadProgress(upload.ReplayName, config.ChannelID, progress, db); err != nil {
+			return "", err
+		}
+	}
+
+	if err := clearExternalUploadProgress(upload.ReplayName, config.ChannelID, db); err != nil {
+		logErrorf("%s", err)
+	}
+
+	return progress.FileId, nil
+}
+
+// sendReplayChunk sends the bytes from the confirmed offset up to end, and returns the offset the upload
+// URL has confirmed afterwards.
+func sendReplayChunk(ctx context.Context, fh *os.File, progress *ExternalUploadProgress, end int64) (int64, error) {
+	start := progress.ConfirmedBytes
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, progress.UploadUrl, io.NewSectionReader(fh, start, end-start))
+	if err != nil {
+		return 0, err
+	}
+	req.ContentLength = end - start
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end-1, progress.TotalBytes))
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	return confirmedUploadOffset(resp, progress.TotalBytes, end)
+}
+
+// queryUploadOffset asks the upload URL how many bytes of the replay it has received, with an empty
+// request whose Content-Range has an unknown range. Only a 308 is taken as an answer; a 200 means the
+// upload URL doesn't support chunked uploads, however many bytes it was sent.
+func queryUploadOffset(ctx context.Context, progress *ExternalUploadProgress) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, progress.UploadUrl, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", progress.TotalBytes))
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusCreated {
+		return 0, errChunkedUploadUnsupported
+	}
+
+	return confirmedUploadOffset(resp, progress.TotalBytes, progress.TotalBytes)
+}
+
+// confirmedUploadOffset reads the offset confirmed by an upload URL's response to a request for the bytes
+// up to end: everything for a 200 once the last byte was sent, or the end of the Range header of a 308.
+func confirmedUploadOffset(resp *http.Response, total int64, end int64) (int64, error) {
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		if end < total {
+			return 0, errChunkedUploadUnsupported
+		}
+		return total, nil
+	case http.StatusPermanentRedirect:
+		received := resp.Header.Get("Range")
+		if received == "" {
+			return 0, nil
+		}
+
+		if !strings.HasPrefix(received, "bytes=0-") {
+			return 0, errors.New(fmt.Sprintf("unexpected Range '%s'", received))
+		}
+		if last, err := strconv.ParseInt(strings.TrimPrefix(received, "bytes=0-"), 10, 64); err != nil {
+			return 0, errors.New(fmt.Sprintf("unexpected Range '%s'", received))
+		} else {
+			return last + 1, nil
+		}
+	default:
+		return 0, errors.New(fmt.Sprintf("unexpected status %d", resp.StatusCode))
+	}
+}
+
+func storedExternalUploadProgress(replayFileName string, channelId string, db *sql.DB) (*ExternalUploadProgress, error) {
+	var progress ExternalUploadProgress
+	err := db.QueryRow("SELECT upload_url, file_id, total_bytes, confirmed_bytes FROM external_upload_progress WHERE replay_file_name = ? AND channel_id = ?;",
+		replayFileName, channelId).Scan(&progress.UploadUrl, &progress.FileId, &progress.TotalBytes, &progress.ConfirmedBytes)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &progress, nil
+}
+
+func storeExternalUploadProgress(replayFileName string, channelId string, progress *ExternalUploadProgress, db *sql.DB) error {
+	_, err := db.Exec(`INSERT OR REPLACE INTO external_upload_progress(replay_file_name, channel_id, upload_url, file_id, total_bytes, confirmed_bytes, updated_at)
+		VALUES(?, ?, ?, ?, ?, ?, ?);`, replayFileName, channelId, progress.UploadUrl, progress.FileId, progress.TotalBytes, progress.ConfirmedBytes, time.Now().Unix())
+	if err != nil {
+		return errors.New(fmt.Sprintf("Error recording the upload progress of replay '%s': %s", replayFileName, err))
+	}
+
+	return nil
+}
+
+func clearExternalUploadProgress(replayFileName string, channelId string, db *sql.DB) error {
+	if _, err := db.Exec("DELETE FROM external_upload_progress WHERE replay_file_name = ? AND channel_id = ?;", replayFileName, channelId); err != nil {
+		return errors.New(fmt.Sprintf("Error clearing the upload progress of replay '%s': %s", replayFileName, err))
+	}
+
+	return nil
+}
+
+// migrateExternalUploadProgressChannel rebuilds external_upload_progress keyed by replay and channel.
+// Uploads in progress before then were for the configured channel.
+func migrateExternalUploadProgressChannel(db *sql.DB, config *Config) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(CREATE_EXTERNAL_UPLOAD_PROGRESS_BY_CHANNEL_SQL); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO external_upload_progress_by_channel
+		SELECT replay_file_name, ?, upload_url, file_id, total_bytes, confirmed_bytes, updated_at FROM external_upload_progress;`, config.ChannelID); err != nil {
+		return err
+	}
+	for _, statement := range []string{
+		"DROP TABLE external_upload_progress;",
+		"ALTER TABLE external_upload_progress_by_channel RENAME TO external_upload_progress;",
+	} {
+		if _, err := tx.Exec(statement); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const UPLOAD_METHOD_FILES_UPLOAD string = "files.upload"
+const UPLOAD_METHOD_EXTERNAL string = "external"
+
+// Replays uploaded with the external flow are recorded here between sending their bytes and completing
+// the upload, so that a retry after a crash or failed completion reuses the same Slack file rather than
+// creating a duplicate.
+const CREATE_EXTERNAL_UPLOADS_SQL string = `CREATE TABLE IF NOT EXISTS external_uploads(
+	replay_file_name varchar(512) PRIMARY KEY,
+	file_id text NOT NULL,
+	created_at integer NOT NULL
+);`
+
+// Rebuilds external_uploads keyed by replay and channel, so that a file uploaded for one channel is never
+// shared in another after ChannelID changes.
+const CREATE_EXTERNAL_UPLOADS_BY_CHANNEL_SQL string = `CREATE TABLE external_uploads_by_channel(
+	replay_file_name text NOT NULL,
+	channel_id varchar(64) NOT NULL,
+	file_id text NOT NULL,
+	created_at integer NOT NULL,
+	PRIMARY KEY(replay_file_name, channel_id)
+);`
+
+// The errors Slack answers files.completeUploadExternal with when the uploaded file can't be shared any
+// more, e.g. because the upload expired before it was completed. Retrying with the same file id never
+// succeeds, so the replay's bytes are sent again instead.
+var SLACK_ERRORS_EXTERNAL_FILE_GONE = []string{"file_not_found", "file_deleted", "upload_expired"}
+
+type UploadUrlResponseBody struct {
+	Ok        bool
+	Error     string
+	Needed    string
+	Provided  string
+	UploadUrl string `json:"upload_url"`
+	FileId    string `json:"file_id"`
+}
+
+// uploadReplayExternal uploads a replay with Slack's two-step external upload flow:
+// files.getUploadURLExternal, a POST of the bytes to the returned URL, then files.completeUploadExternal.
+func uploadReplayExternal(ctx context.Context, upload *ReplayUpload, db *sql.DB, config *Config) (responseBody *ResponseBody, err error) {
+	logInfof("Uploading replay '%s'", upload.FilePath)
+
+	ctx, span := startSpan(ctx, "files.uploadExternal", SPAN_KIND_CLIENT)
+	defer func() { span.end(err) }()
+	span.setAttribute("replay.filename", upload.FileName)
+	span.setAttribute("slack.channel", config.ChannelID)
+
+	fileId, err := sendOrResumeReplayExternal(ctx, upload, db, config)
+	if err != nil {
+		return nil, err
+	}
+
+	responseBody, err = completeUploadExternal(ctx, fileId, upload, config)
+	if externalFileGone(err) {
+		logWarnf("Slack file '%s' of replay '%s' can't be shared any more (%s), uploading the replay again", fileId, upload.FilePath, err)
+		if err := clearExternalFileId(upload.ReplayName, config.ChannelID, db); err != nil {
+			return nil, err
+		}
+
+		if fileId, err = sendOrResumeReplayExternal(ctx, upload, db, config); err != nil {
+			return nil, err
+		}
+		responseBody, err = completeUploadExternal(ctx, fileId, upload, config)
+		if externalFileGone(err) {
+			if err := clearExternalFileId(upload.ReplayName, config.ChannelID, db); err != nil {
+				logErrorf("%s", err)
+			}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := clearExternalFileId(upload.ReplayName, config.ChannelID, db); err != nil {
+		logErrorf("%s", err)
+	}
+
+	return responseBody, nil
+}
+
+// sendOrResumeReplayExternal sends a replay's bytes with the external upload flow and records the id of
+// the Slack file they were uploaded as, or returns the id recorded by an earlier attempt that was never
+// completed.
+func sendOrResumeReplayExternal(ctx context.Context, upload *ReplayUpload, db *sql.DB, config *Config) (string, error) {
+	fileId, err := storedExternalFileId(upload.ReplayName, config.ChannelID, db)
+	if err != nil {
+		return "", err
+	}
+
+	if fileId != "" {
+		logInfof("Resuming the upload of replay '%s' as Slack file '%s'", upload.FilePath, fileId)
+		return fileId, nil
+	}
+
+	if fileId, err = sendReplayBytesExternal(ctx, upload, db, config); err != nil {
+		return "", err
+	}
+
+	if err := storeExternalFileId(upload.ReplayName, config.ChannelID, fileId, db); err != nil {
+		return "", err
+	}
+
+	return fileId, nil
+}
+
+// sendReplayBytesExternal reserves an upload URL for the replay and sends its bytes there, returning
+// the id of the Slack file they were uploaded as. Replays larger than ExternalUploadChunkBytes are sent
+// in chunks, or in a single request to a new upload URL if the upload URL turns out not to support them.
+func sendReplayBytesExternal(ctx context.Context, upload *ReplayUpload, db *sql.DB, config *Config) (string, error) {
+	fh, err := os.Open(upload.FilePath)
+	if err != nil {
+		return "", err
+	}
+	defer fh.Close()
+
+	info, err := fh.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	if config.ExternalUploadChunkBytes > 0 && info.Size() > int64(config.ExternalUploadChunkBytes) {
+		fileId, err := sendReplayChunksExternal(ctx, upload, fh, info.Size(), db, config)
+		if !errors.Is(err, errChunkedUploadUnsupported) {
+			return fileId, err
+		}
+		logWarnf("upload URL doesn't support chunked uploads, sending replay '%s' in a single request instead; unset ExternalUploadChunkBytes", upload.FilePath)
+	}
+
+	uploadUrlResponse, err := reserveUploadUrlExternal(ctx, upload, info.Size(), config)
+	if err != nil {
+		return "", err
+	}
+
+	replayFile := newProgressReader(fh, info.Size(), upload.FilePath, config)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, uploadUrlResponse.UploadUrl, replayFile)
+	if err != nil {
+		return "", err
+	}
+	req.ContentLength = info.Size()
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.New(fmt.Sprintf("Error uploading replay '%s': %d", upload.FilePath, resp.StatusCode))
+	}
+
+	return uploadUrlResponse.FileId, nil
+}
+
+// reserveUploadUrlExternal asks Slack for a URL to send size bytes of the replay to.
+func reserveUploadUrlExternal(ctx context.Context, upload *ReplayUpload, size int64, config *Config) (*UploadUrlResponseBody, error) {
+	params := url.Values{}
+	params.Set("filename", upload.FileName)
+	params.Set("length", strconv.FormatInt(size, 10))
+
+	var uploadUrlResponse UploadUrlResponseBody
+	if err := callSlackApi(ctx, "files.getUploadURLExternal", params, &uploadUrlResponse, config); err != nil {
+		return nil, err
+	}
+	if !uploadUrlResponse.Ok {
+		return nil, errors.New(fmt.Sprintf("Error reserving an upload URL for replay '%s': %s", upload.FilePath,
+			slackErrorDetail(uploadUrlResponse.Error, uploadUrlResponse.Needed, uploadUrlResponse.Provided)))
+	}
+
+	return &uploadUrlResponse, nil
+}
+
+// completeUploadExternal shares an uploaded Slack file in the configured channel, unless it's unshared.
+func completeUploadExternal(ctx context.Context, fileId string, upload *ReplayUpload, config *Config) (*ResponseBody, error) {
+	return completeUploadsExternal(ctx, []string{fileId}, []*ReplayUpload{upload}, config)
+}
+
+// completeUploadsExternal shares uploaded Slack files together in a single message in the configured
+// channel, with their messages joined into one. The first upload decides the thread and whether the
+// files are shared at all.
+func completeUploadsExternal(ctx context.Context, fileIds []string, uploads []*ReplayUpload, config *Config) (*ResponseBody, error) {
+	files := make([]map[string]string, len(fileIds))
+	comments := make([]string, 0, len(uploads))
+	for i, upload := range uploads {
+		title := upload.FileName
+		if upload.Title != "" {
+			title = upload.Title
+		}
+		files[i] = map[string]string{"id": fileIds[i], "title": title}
+		if upload.InitialComment != "" {
+			comments = append(comments, upload.InitialComment)
+		}
+	}
+
+	filesJson, err := json.Marshal(files)
+	if err != nil {
+		return nil, err
+	}
+
+	params := url.Values{}
+	params.Set("files", string(filesJson))
+	if !uploads[0].Unshared {
+		params.Set("channel_id", config.ChannelID)
+		if len(comments) > 0 {
+			params.Set("initial_comment", strings.Join(comments, "\n"))
+		}
+		if uploads[0].ThreadTs != "" {
+			params.Set("thread_ts", uploads[0].ThreadTs)
+		}
+	}
+
+	var responseBody ResponseBody
+	if err := callSlackApi(ctx, "files.completeUploadExternal", params, &responseBody, config); err != nil {
+		return nil, err
+	}
+	responseBody.logWarning()
+
+	if !responseBody.Ok {
+		return nil, &SlackApiError{responseBody.Error, errors.New(fmt.Sprintf("Error uploading replay: %s",
+			slackErrorDetail(responseBody.Error, responseBody.Needed, responseBody.Provided)))}
+	}
+
+	if len(responseBody.Files) > 0 {
+		responseBody.File = responseBody.Files[0]
+	}
+
+	return &responseBody, nil
+}
+
+// callSlackApi calls a Slack Web API method with form-encoded params and decodes its JSON response into
+// responseBody.
+func callSlackApi(ctx context.Context, method string, params url.Values, responseBody interface{}, config *Config) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, slackApiUrl(method, config), strings.NewReader(params.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer "+config.AuthToken)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(fmt.Sprintf("Error calling %s: %d", method, resp.StatusCode))
+	}
+
+	return json.NewDecoder(resp.Body).Decode(responseBody)
+}
+
+// externalFileGone reports whether err is Slack refusing to share an uploaded file because it's gone.
+func externalFileGone(err error) bool {
+	var apiErr *SlackApiError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+
+	for _, code := range SLACK_ERRORS_EXTERNAL_FILE_GONE {
+		if apiErr.Code == code {
+			return true
+		}
+	}
+
+	return false
+}
+
+func storedExternalFileId(replayFileName string, channelId string, db *sql.DB) (string, error) {
+	var fileId string
+	err := db.QueryRow("SELECT file_id FROM external_uploads WHERE replay_file_name = ? AND channel_id = ?;", replayFileName, channelId).Scan(&fileId)
+	if err == sql.ErrNoRows {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	return fileId, nil
+}
+
+func storeExternalFileId(replayFileName string, channelId string, fileId string, db *sql.DB) error {
+	_, err := db.Exec("INSERT OR REPLACE INTO external_uploads(replay_file_name, channel_id, file_id, created_at) VALUES(?, ?, ?, ?);",
+		replayFileName, channelId, fileId, time.Now().Unix())
+	if err != nil {
+		return errors.New(fmt.Sprintf("Error recording Slack file '%s' for replay '%s': %s", fileId, replayFileName, err))
+	}
+
+	return nil
+}
+
+func clearExternalFileId(replayFileName string, channelId string, db *sql.DB) error {
+	if _, err := db.Exec("DELETE FROM external_uploads WHERE replay_file_name = ? AND channel_id = ?;", replayFileName, channelId); err != nil {
+		return errors.New(fmt.Sprintf("Error clearing the Slack file recorded for replay '%s': %s", replayFileName, err))
+	}
+
+	return nil
+}
+
+// migrateExternalUploadsChannel rebuilds external_uploads keyed by replay and channel. File ids recorded
+// before then were uploaded for the configured channel.
+func migrateExternalUploadsChannel(db *sql.DB, config *Config) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(CREATE_EXTERNAL_UPLOADS_BY_CHANNEL_SQL); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO external_uploads_by_channel SELECT replay_file_name, ?, file_id, created_at FROM external_uploads;", config.ChannelID); err != nil {
+		return err
+	}
+	for _, statement := range []string{
+		"DROP TABLE external_uploads;",
+		"ALTER TABLE external_uploads_by_channel RENAME TO external_uploads;",
+	} {
+		if _, err := tx.Exec(statement); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,21 @@
+//go:build cgo
+
+package main
+
+import (
+	"errors"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// dbFull reports whether err is SQLite failing to write because the disk is full.
+func dbFull(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.Code == sqlite3.ErrFull
+}
+
+// dbBusy reports whether err is SQLite's "database is locked" or "database table is locked".
+func dbBusy(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && (sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked)
+}
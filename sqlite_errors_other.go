@@ -0,0 +1,25 @@
+//go:build !cgo
+
+package main
+
+import (
+	"strings"
+)
+
+// Without cgo, go-sqlite3 doesn't export its error codes, so these go by the error's message.
+
+// dbFull reports whether err is SQLite failing to write because the disk is full.
+func dbFull(err error) bool {
+	return err != nil && (strings.Contains(err.Error(), "database or disk is full") || strings.Contains(err.Error(), "SQLITE_FULL"))
+}
+
+// dbBusy reports whether err is SQLite's "database is locked" or "database table is locked".
+func dbBusy(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	message := err.Error()
+	return strings.Contains(message, "database is locked") || strings.Contains(message, "database table is locked") ||
+		strings.Contains(message, "SQLITE_BUSY") || strings.Contains(message, "SQLITE_LOCKED")
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const DEFAULT_STARTUP_RETRY_DELAY_SECONDS int = 5
+
+// waitForStartupDependencies initializes the database and, if requireReplayDirectory is set, checks that
+// the replay directory is there, trying again StartupRetries times StartupRetryDelaySeconds apart, so that
+// a network mount that isn't ready yet at boot doesn't stop the uploader. It returns the last error if
+// they never become available.
+func waitForStartupDependencies(config *Config, requireReplayDirectory bool, clock Clock) error {
+	for retry := 0; ; retry++ {
+		err := startupDependenciesError(config, requireReplayDirectory)
+		if err == nil || retry >= config.StartupRetries {
+			return err
+		}
+
+		logWarnf("%s; retrying in %d seconds (%d of %d)", err, config.StartupRetryDelaySeconds, retry+1, config.StartupRetries)
+		clock.Sleep(time.Duration(config.StartupRetryDelaySeconds) * time.Second)
+	}
+}
+
+func startupDependenciesError(config *Config, requireReplayDirectory bool) error {
+	if err := initializeDbIfNotExist(config.DatabasePath, config); err != nil {
+		return &DatabaseError{errors.New(fmt.Sprintf("Error initializing the database at '%s': %s", config.DatabasePath, err))}
+	}
+
+	if requireReplayDirectory {
+		return replayDirectoryError(config)
+	}
+
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"time"
+)
+
+// The number of uploads and errors listed on the status page.
+const STATUS_PAGE_ROWS int = 20
+
+type QueuedReplay struct {
+	ReplayName string    `json:"replay_name"`
+	Status     string    `json:"status"`
+	Attempts   int       `json:"attempts"`
+	LastError  string    `json:"last_error,omitempty"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// UploadsOverview is what the status page shows, read from the upload queue.
+type UploadsOverview struct {
+	PendingCount  int            `json:"pending_count"`
+	RecentUploads []QueuedReplay `json:"recent_uploads"`
+	RecentErrors  []QueuedReplay `json:"recent_errors"`
+	PostedCount   int            `json:"posted_replay_count"`
+}
+
+func loadUploadsOverview(db *sql.DB) (*UploadsOverview, error) {
+	overview := &UploadsOverview{}
+
+	err := db.QueryRow("SELECT COUNT(*) FROM upload_queue WHERE status IN (?, ?);", QUEUE_STATUS_PENDING, QUEUE_STATUS_FAILED).Scan(&overview.PendingCount)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.QueryRow("SELECT COUNT(*) FROM posted_replays;").Scan(&overview.PostedCount); err != nil {
+		return nil, err
+	}
+
+	if overview.RecentUploads, err = queryQueuedReplays(db, "status = ?", QUEUE_STATUS_DONE); err != nil {
+		return nil, err
+	}
+	if overview.RecentErrors, err = queryQueuedReplays(db, "last_error IS NOT NULL AND status != ?", QUEUE_STATUS_DONE); err != nil {
+		return nil, err
+	}
+
+	return overview, nil
+}
+
+// queryQueuedReplays returns the most recently updated replays in the upload queue matching where.
+func queryQueuedReplays(db *sql.DB, where string, args ...interface{}) ([]QueuedReplay, error) {
+	rows, err := db.Query("SELECT replay_file_name, status, attempts, COALESCE(last_error, ''), updated_at FROM upload_queue WHERE "+where+
+		" ORDER BY updated_at DESC, replay_file_name LIMIT ?;", append(args, STATUS_PAGE_ROWS)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	replays := make([]QueuedReplay, 0)
+	for rows.Next() {
+		var replay QueuedReplay
+		var updatedAt int64
+		if err := rows.Scan(&replay.ReplayName, &replay.Status, &replay.Attempts, &replay.LastError, &updatedAt); err != nil {
+			return nil, err
+		}
+		replay.UpdatedAt = time.Unix(updatedAt, 0)
+		replays = append(replays, replay)
+	}
+
+	return replays, rows.Err()
+}
+
+var statusPageTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><meta http-equiv="refresh" content="30"><title>Replay uploads</title></head>
+<body>
+<h1>Replay uploads</h1>
+<p>{{.PendingCount}} pending, {{.PostedCount}} posted in total.</p>
+<h2>Recent uploads</h2>
+<table>
+<tr><th>Replay</th><th>Uploaded</th><th>Attempts</th></tr>
+{{range .RecentUploads}}<tr><td>{{.ReplayName}}</td><td>{{.UpdatedAt.Format "2006-01-02 15:04:05"}}</td><td>{{.Attempts}}</td></tr>
+{{else}}<tr><td colspan="3">None yet</td></tr>
+{{end}}</table>
+<h2>Recent errors</h2>
+<table>
+<tr><th>Replay</th><th>Status</th><th>At</th><th>Attempts</th><th>Error</th></tr>
+{{range .RecentErrors}}<tr><td>{{.ReplayName}}</td><td>{{.Status}}</td><td>{{.UpdatedAt.Format "2006-01-02 15:04:05"}}</td><td>{{.Attempts}}</td><td>{{.LastError}}</td></tr>
+{{else}}<tr><td colspan="5">None</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// uploadsHandler serves the uploads overview, as an HTML page or, with asJson, as JSON.
+func uploadsHandler(db *sql.DB, asJson bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		overview, err := loadUploadsOverview(db)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if asJson {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(overview)
+		} else {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			statusPageTemplate.Execute(w, overview)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ScanStatus records the outcome of the most recent scans for the status endpoints. It is shared
+// between the watch loop and the HTTP server, so all access goes through its mutex.
+type ScanStatus struct {
+	mutex         sync.Mutex
+	clock         Clock
+	lastScanTime  time.Time
+	lastError     error
+	lastErrorTime time.Time
+}
+
+type StatusResponse struct {
+	Healthy       bool       `json:"healthy"`
+	DiskFull      bool       `json:"disk_full"`
+	LastScanTime  *time.Time `json:"last_scan_time,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+	LastErrorTime *time.Time `json:"last_error_time,omitempty"`
+}
+
+// recordScan notes that a scan finished with scanErr, clearing any previous error on success.
+func (s *ScanStatus) recordScan(scanErr error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.lastScanTime = s.clock.Now()
+	s.lastError = scanErr
+	if scanErr != nil {
+		s.lastErrorTime = s.lastScanTime
+	}
+}
+
+func (s *ScanStatus) snapshot() StatusResponse {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	response := StatusResponse{Healthy: s.lastError == nil && !diskSpace.isFull(), DiskFull: diskSpace.isFull()}
+	if !s.lastScanTime.IsZero() {
+		lastScanTime := s.lastScanTime
+		response.LastScanTime = &lastScanTime
+	}
+	if s.lastError != nil {
+		lastErrorTime := s.lastErrorTime
+		response.LastError = s.lastError.Error()
+		response.LastErrorTime = &lastErrorTime
+	}
+
+	return response
+}
+
+// startStatusServer serves the scan status on listenAddress in the background:
+//
+//	/healthz responds 200 when the last scan succeeded and 503 when it failed or a disk is full
+//	/status  responds with the last scan time and error, and whether a disk is full, as JSON
+//	/metrics responds with counters in the Prometheus text format
+//	/        responds with a page listing the pending count, recent uploads and recent errors
+//	/uploads responds with the same as JSON
+func startStatusServer(listenAddress string, status *ScanStatus, db *sql.DB) {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if response := status.snapshot(); response.Healthy {
+			w.Write([]byte("ok\n"))
+		} else if response.DiskFull {
+			http.Error(w, strings.TrimSpace("disk full\n"+response.LastError), http.StatusServiceUnavailable)
+		} else {
+			http.Error(w, response.LastError, http.StatusServiceUnavailable)
+		}
+	})
+
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status.snapshot())
+	})
+
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		fmt.Fprintf(w, "# HELP towerfall_replay_uploaded_bytes_total Bytes sent in replay upload request bodies.\n")
+		fmt.Fprintf(w, "# TYPE towerfall_replay_uploaded_bytes_total counter\n")
+		fmt.Fprintf(w, "towerfall_replay_uploaded_bytes_total %d\n", atomic.LoadInt64(&uploadedBytesTotal))
+	})
+
+	mux.HandleFunc("/uploads", uploadsHandler(db, true))
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		uploadsHandler(db, false)(w, r)
+	})
+
+	go func() {
+		logInfof("Serving status on '%s'", listenAddress)
+		if err := http.ListenAndServe(listenAddress, mux); err != nil {
+			logErrorf("Error serving status on '%s': %s", listenAddress, err)
+		}
+	}()
+}
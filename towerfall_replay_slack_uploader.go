@@ -1,7 +1,8 @@
 package main
 
 import (
-	"bytes"
+	"compress/gzip"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
@@ -9,247 +10,1777 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 	"io"
 	"io/ioutil"
-	"log"
+	"math/rand"
 	"mime/multipart"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
 	"time"
 )
 
-const SLACK_API_URL string = "https://slack.com/api/files.upload"
+const DEFAULT_SLACK_API_BASE_URL string = "https://slack.com"
 const DB_PATH string = "./posted_replays.sqlite.db"
 const CONF_PATH string = "./towerfall_replay_slack_uploader_conf.json"
-const CHECK_INTERVAL_SECONDS time.Duration = time.Duration(30)
+const CHECK_INTERVAL_SECONDS int = 30
+const REPLAY_GLOB string = "*.gif"
+
+const DEFAULT_DEBOUNCE_SECONDS int = 3
+const DEFAULT_DB_MAX_OPEN_CONNS int = 1
+const DEFAULT_DB_BUSY_TIMEOUT_MS int = 5000
+
+// SettleMode decides how a replay that's still being written is told apart from a finished one.
+const SETTLE_MODE_MTIME string = "mtime"
+const SETTLE_MODE_SIZE string = "size"
+
+const UPLOAD_ORDER_NAME string = "name"
+const UPLOAD_ORDER_MTIME string = "mtime"
+
+const DEFAULT_FILE_DATE_LAYOUT string = "2006-01-02 15:04 MST"
+
+// Replays are recorded per channel, so that the same replay may be posted to several channels. These
+// statements take the replay's file name, the channel and, for the insert, the target. Recording a replay
+// that's already recorded, e.g. by a racing scan, does nothing.
+const DEDUP_SELECT_SQL string = "SELECT COUNT(*) FROM posted_replays WHERE replay_file_name = ? AND channel_id = ?"
+const DEDUP_INSERT_SQL string = `INSERT INTO posted_replays(replay_file_name, channel_id, target) VALUES(?, ?, ?)
+	ON CONFLICT(replay_file_name, channel_id) DO NOTHING;`
+
+// Databases from before the index may hold duplicates, which have to go before it can be created.
+const DEDUPLICATE_POSTED_REPLAYS_SQL string = `DELETE FROM posted_replays WHERE rowid NOT IN (
+	SELECT MIN(rowid) FROM posted_replays GROUP BY replay_file_name, channel_id);`
+const CREATE_POSTED_REPLAYS_INDEX_SQL string = `CREATE UNIQUE INDEX IF NOT EXISTS posted_replays_replay_channel
+	ON posted_replays(replay_file_name, channel_id);`
+
+const MISSING_DIRECTORY_WAIT string = "wait"
+const MISSING_DIRECTORY_EXIT string = "exit"
 
 func main() {
-	success := true
-	if config, err := readConfig(CONF_PATH); err != nil {
-		log.Printf("Error reading the configuration at '%s': %s", CONF_PATH, err)
-		success = false
+	if exitWith := runCommand(os.Args[1:], os.Stdout); exitWith != 0 {
+		os.Exit(exitWith)
+	}
+}
+
+// watch runs the uploader with the configuration at confPath, scanning the replay directory once or
+// watching it, and returns the code to exit with.
+func watch(confPath string, once bool) int {
+	exitWith := 0
+	if config, err := readConfig(confPath); err != nil {
+		logErrorf("Error reading the configuration at '%s': %s", confPath, err)
+		exitWith = exitCode(err)
 	} else {
-		if err = initializeDbIfNotExist(DB_PATH); err != nil {
-			log.Printf("Error initializing the database at '%s': %s", DB_PATH, err)
-			success = false
+		setLogLevel(config.LogLevel)
+		if err := setUpLogFile(config); err != nil {
+			logErrorf("Error opening the log file '%s', logging to standard error only: %s", config.LogFilePath, err)
+		}
+		logInfof("Effective configuration: %s", config.summary())
+		configureHttpClient(config)
+		logDebugf("Full effective configuration: %s", config)
+
+		if config.OTLPEndpoint != "" {
+			startTracing(config.OTLPEndpoint)
+		}
+
+		// with -once or MissingDirectoryPolicy "exit", a missing replay directory would stop the uploader
+		requireReplayDirectory := once || config.MissingDirectoryPolicy == MISSING_DIRECTORY_EXIT
+		if err = waitForStartupDependencies(config, requireReplayDirectory, RealClock{}); err != nil {
+			logErrorf("%s", err)
+			exitWith = exitCode(err)
+		} else if err = checkTargetAuth(config); err != nil {
+			logErrorf("Error checking the configured credentials: %s", err)
+			exitWith = exitCode(err)
+		} else if once {
+			if err = scanReplayDirOnce(config.DatabasePath, config); err != nil {
+				logErrorf("Error scanning the replay directory: %s", err)
+				exitWith = exitCode(err)
+			}
 		} else {
-			if err = watchReplayDir(DB_PATH, config); err != nil {
-				log.Printf("Error watching the replay directory: %s", err)
-				success = false
+			if err = watchReplayDir(confPath, config, RealClock{}); err != nil {
+				logErrorf("Error watching the replay directory: %s", err)
+				exitWith = exitCode(err)
 			}
 		}
 	}
 
-	if !success {
-		os.Exit(1)
+	return exitWith
+}
+
+// checkConfigAndExitCode reads and validates the configuration at confPath for check-config, printing
+// whether it's valid to out, and returns the code to exit with.
+func checkConfigAndExitCode(confPath string, checkAuth bool, out io.Writer) int {
+	config, err := readConfig(confPath)
+	if err != nil {
+		fmt.Fprintf(out, "Configuration at '%s' is invalid: %s\n", confPath, err)
+		return exitCode(err)
+	}
+
+	if checkAuth {
+		var configErr *ConfigError
+		if err := checkTargetAuth(config); errors.As(err, &configErr) {
+			fmt.Fprintf(out, "Configuration at '%s' is valid, but its credentials were rejected: %s\n", confPath, err)
+			return EXIT_CODE_CONFIG
+		} else if err != nil {
+			fmt.Fprintf(out, "Configuration at '%s' is valid, but its credentials couldn't be checked: %s\n", confPath, err)
+			return exitCode(err)
+		}
 	}
+
+	fmt.Fprintf(out, "Configuration at '%s' is valid: posting replays from '%s' to %s channel '%s'\n", confPath,
+		config.ReplayDirectoryPath, config.Target, config.ChannelID)
+	return 0
 }
 
-func watchReplayDir(dbPath string, config *Config) error {
-	if db, err := sql.Open("sqlite3", dbPath); err != nil {
-		return err
+// watchReplayDir scans the replay directory every CheckIntervalSeconds until a scan fails. Sending the
+// process SIGHUP re-reads the configuration at confPath and applies it from the next scan on. All waiting
+// and scheduling goes through clock.
+func watchReplayDir(confPath string, config *Config, clock Clock) error {
+	if db, err := openDb(config.DatabasePath, config); err != nil {
+		return &DatabaseError{err}
 	} else {
-		log.Printf("Watching directory '%s' for replays to upload...", config.ReplayDirectoryPath)
+		logInfof("towerfall_replay_slack_uploader %s watching directory '%s' for replays to upload...", versionString(), config.ReplayDirectoryPath)
+		systemClock = clock
+		state := newScanStateWithClock(clock)
+		if config.StatusListenAddress != "" {
+			startStatusServer(config.StatusListenAddress, state.status, db)
+		}
+
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
+		defer signal.Stop(reload)
+
+		if !config.ScanOnStartup {
+			logInfof("Waiting %d seconds before the first scan", config.CheckIntervalSeconds)
+			clock.Sleep(time.Duration(config.CheckIntervalSeconds) * time.Second)
+		}
+
+		lastFailedRetry := clock.Now()
 		for {
-			if err := checkAndUploadReplays(db, config); err != nil {
+			if err := keepWatchingIfDiskFull(keepWatchingAfterUploadFailures(checkAndUploadReplaysWithTimeout(db, config, state), config), config); err != nil {
 				return err
 			}
-			time.Sleep(CHECK_INTERVAL_SECONDS * time.Second)
+
+			if config.FailedRetryIntervalSeconds > 0 && clock.Now().Sub(lastFailedRetry) >= time.Duration(config.FailedRetryIntervalSeconds)*time.Second {
+				if err := keepWatchingIfDiskFull(keepWatchingAfterUploadFailures(retryFailedReplays(context.Background(), db, config, state), config), config); err != nil {
+					return err
+				}
+				lastFailedRetry = clock.Now()
+			}
+
+			select {
+			case <-reload:
+				config = reloadConfig(confPath, config)
+			case <-clock.After(nextCheckInterval(config)):
+			}
 		}
 	}
 }
 
-func checkAndUploadReplays(db *sql.DB, config *Config) error {
-	if replayPaths, err := filepath.Glob(filepath.Join(config.ReplayDirectoryPath, "*.gif")); err != nil {
-		return err
+// nextCheckInterval returns how long to wait before the next scan: CheckIntervalSeconds, randomly
+// adjusted by up to CheckIntervalJitterSeconds or CheckIntervalJitterPercent either way so that several
+// uploaders started together drift apart rather than scanning in lockstep.
+func nextCheckInterval(config *Config) time.Duration {
+	interval := time.Duration(config.CheckIntervalSeconds) * time.Second
+
+	var maxJitter int64
+	if config.CheckIntervalJitterSeconds > 0 {
+		maxJitter = int64(time.Duration(config.CheckIntervalJitterSeconds) * time.Second)
+	} else if config.CheckIntervalJitterPercent > 0 {
+		maxJitter = int64(interval) * int64(config.CheckIntervalJitterPercent) / 100
 	} else {
-		for replayPathsIdx := range replayPaths {
+		return interval
+	}
 
-			replayFilePath := replayPaths[replayPathsIdx]
-			replayName := filepath.Base(replayFilePath)
+	return interval + time.Duration(rand.Int63n(2*maxJitter+1)-maxJitter)
+}
 
-			if replayUploaded, uploadedCheckError := checkReplayAlreadyUploaded(replayName, db); uploadedCheckError != nil {
-				return uploadedCheckError
-			} else {
-				if !replayUploaded {
-					if err := uploadReplay(replayFilePath, config); err != nil {
-						return err
-					} else {
-						log.Printf("Uploaded replay '%s'", replayFilePath)
-						if err := recordReplayWasUploaded(replayName, db); err != nil {
-							return err
-						}
-					}
-				}
-			}
-		}
+func scanReplayDirOnce(dbPath string, config *Config) error {
+	db, err := openDb(dbPath, config)
+	if err != nil {
+		return &DatabaseError{err}
 	}
+	defer db.Close()
 
-	return nil
+	logInfof("towerfall_replay_slack_uploader %s scanning directory '%s' for replays to upload...", versionString(), config.ReplayDirectoryPath)
+	if err := replayDirectoryError(config); err != nil {
+		return err
+	}
+
+	ctx, cancel := scanContext(config)
+	defer cancel()
+	return checkAndUploadReplays(ctx, db, config, newScanState())
 }
 
-func uploadReplay(replayFilePath string, config *Config) error {
-	log.Printf("Uploading replay '%s'", replayFilePath)
+// scanContext returns the context for a single scan, which is cancelled after ScanTimeoutSeconds if set.
+func scanContext(config *Config) (context.Context, context.CancelFunc) {
+	if config.ScanTimeoutSeconds > 0 {
+		return context.WithTimeout(context.Background(), time.Duration(config.ScanTimeoutSeconds)*time.Second)
+	}
 
-	bodyBuf := &bytes.Buffer{}
-	bodyWriter := multipart.NewWriter(bodyBuf)
-	defer bodyWriter.Close()
+	return context.WithCancel(context.Background())
+}
 
-	replayFileName := filepath.Base(replayFilePath)
+// checkAndUploadReplaysWithTimeout runs a scan for watchReplayDir. A scan that runs past
+// ScanTimeoutSeconds is abandoned, cancelling any upload in progress, and the watcher carries on with
+// the next scan.
+func checkAndUploadReplaysWithTimeout(db *sql.DB, config *Config, state *ScanState) error {
+	ctx, cancel := scanContext(config)
+	defer cancel()
 
-	fileWriter, err := bodyWriter.CreateFormFile("file", replayFileName)
-	if err != nil {
-		return err
+	err := checkAndUploadReplays(ctx, db, config, state)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		logWarnf("scan was abandoned after ScanTimeoutSeconds (%d), remaining replays will be uploaded by later scans: %s", config.ScanTimeoutSeconds, err)
+		return nil
 	}
 
-	fh, err := os.Open(replayFilePath)
-	if err != nil {
-		return err
+	return err
+}
+
+func checkAndUploadReplays(ctx context.Context, db *sql.DB, config *Config, state *ScanState) (err error) {
+	ctx, span := startSpan(ctx, "scan", SPAN_KIND_INTERNAL)
+	defer func() {
+		span.end(err)
+		state.status.recordScan(err)
+	}()
+
+	// a missing directory globs to no replays at all, which mustn't pass for there being nothing new
+	if dirErr := replayDirectoryError(config); dirErr != nil {
+		if config.MissingDirectoryPolicy == MISSING_DIRECTORY_EXIT {
+			return dirErr
+		}
+
+		if !state.replayDirectoryMissing {
+			logWarnf("%s, waiting for it to come back", dirErr)
+			state.replayDirectoryMissing = true
+		}
+		return nil
+	} else if state.replayDirectoryMissing {
+		logInfof("Replay directory '%s' is back, resuming uploads", config.ReplayDirectoryPath)
+		state.replayDirectoryMissing = false
 	}
-	defer fh.Close()
 
-	if _, err := io.Copy(fileWriter, fh); err != nil {
+	if err := diskSpace.recordUnrecordedUploads(db, config); err != nil {
 		return err
 	}
 
-	// add the auth token
-	tokenField, err := bodyWriter.CreateFormField("token")
+	replayPaths, err := findPendingReplays(db, config, state)
 	if err != nil {
 		return err
 	}
-	tokenField.Write([]byte(config.AuthToken))
 
-	// add the filename
-	filenameField, err := bodyWriter.CreateFormField("filename")
-	if err != nil {
-		return err
+	if len(replayPaths) == 0 {
+		return nil
 	}
-	filenameField.Write([]byte(replayFileName))
 
-	// add the channel to post this to
-	channelField, err := bodyWriter.CreateFormField("channels")
-	if err != nil {
-		return err
+	if config.DigestMode {
+		// queue the replays as they're found, so the database shows what the next digest will hold
+		for _, replayFilePath := range replayPaths {
+			if err := enqueueReplay(filepath.Base(replayFilePath), db); err != nil {
+				return &DatabaseError{err}
+			}
+		}
+
+		if !state.digest.due(state.clock.Now(), replayPaths, config) {
+			logDebugf("Holding %d pending replay(s) for the next digest", len(replayPaths))
+			return nil
+		}
+		logInfof("Posting a digest of %d replay(s)", len(replayPaths))
+	} else if !state.bundler.ready(replayPaths, time.Duration(config.BundleWindowSeconds)*time.Second) {
+		logDebugf("Waiting for more replays before posting %d pending replay(s)", len(replayPaths))
+		return nil
 	}
-	channelField.Write([]byte(config.ChannelID))
 
-	contentType := bodyWriter.FormDataContentType()
-	bodyWriter.Close()
+	if !minBatchReady(replayPaths, state.clock.Now(), config) {
+		logDebugf("Waiting for %d pending replay(s) before posting, have %d", config.MinBatchSize, len(replayPaths))
+		return nil
+	}
 
-	resp, err := http.Post(SLACK_API_URL, contentType, bodyBuf)
-	if err != nil {
-		return err
+	allPending := true
+	if limit := state.uploadLimiter.allowed(config); limit >= 0 && limit < len(replayPaths) {
+		logInfof("Throttling uploads, deferring %d replay(s) to a later scan", len(replayPaths)-limit)
+		replayPaths = replayPaths[:limit]
+		allPending = false
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return errors.New(fmt.Sprintf("Error uploading replay '%s': %d", replayFilePath, resp.StatusCode))
+	uploadReplays := uploadReplaysOneByOne
+	if config.BatchUpload {
+		uploadReplays = uploadReplaysInBatches
 	}
+	err = uploadReplays(ctx, replayPaths, db, config, state)
 
-	if err := checkResponseOk(resp.Body); err != nil {
-		return err
+	// with ContinueOnError, the replays that did go out were posted as the digest
+	var uploadErr *UploadError
+	if config.DigestMode && allPending && (err == nil || (config.ContinueOnError && errors.As(err, &uploadErr))) {
+		state.digest.posted(state.clock.Now())
+	}
+
+	return err
+}
+
+// uploadReplaysOneByOne posts each pending replay of a scan in its own message, threading them under the
+// first with BundleThread or DigestMode.
+func uploadReplaysOneByOne(ctx context.Context, replayPaths []string, db *sql.DB, config *Config, state *ScanState) error {
+	threadTs := ""
+	processed := make(map[string]bool)
+	var failures []*UploadError
+	for _, replayFilePath := range replayPaths {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if processed[inFlightKey(replayFilePath)] {
+			logDebugf("Replay '%s' was already processed in this scan, skipping it", replayFilePath)
+			continue
+		}
+		processed[inFlightKey(replayFilePath)] = true
+
+		if !state.inFlight.add(replayFilePath) {
+			logDebugf("Replay '%s' is already being uploaded, skipping it", replayFilePath)
+			continue
+		}
+
+		ts, err := uploadAndRecordReplay(ctx, replayFilePath, threadTs, db, config)
+		state.inFlight.remove(replayFilePath)
+		state.uploadLimiter.recordUpload()
+
+		if continueAfterUploadError(err, &failures, config) {
+			continue
+		} else if err != nil {
+			return err
+		} else if (config.BundleThread || config.DigestMode) && threadTs == "" {
+			threadTs = ts
+		}
+	}
+
+	return uploadFailuresError(failures)
+}
+
+// continueAfterUploadError reports whether the scan should carry on with the next replay after err,
+// which it does for a replay that failed to upload when ContinueOnError is set. The failure is logged
+// and added to failures.
+func continueAfterUploadError(err error, failures *[]*UploadError, config *Config) bool {
+	var uploadErr *UploadError
+	if !config.ContinueOnError || !errors.As(err, &uploadErr) {
+		return false
+	}
+
+	logErrorf("Error uploading replay '%s', carrying on with the rest: %s", uploadErr.ReplayFilePath, uploadErr.err)
+	*failures = append(*failures, uploadErr)
+	return true
+}
+
+// uploadFailuresError returns an UploadError for the replays that failed to upload in a scan with
+// ContinueOnError, naming the first of them, so the scan still counts as failed, or nil if none did.
+func uploadFailuresError(failures []*UploadError) error {
+	if len(failures) == 0 {
+		return nil
+	}
+
+	replayNames := make([]string, 0, len(failures))
+	for _, failure := range failures {
+		replayNames = append(replayNames, filepath.Base(failure.ReplayFilePath))
+	}
+	return &UploadError{failures[0].ReplayFilePath, errors.New(fmt.Sprintf("%d replay(s) failed to upload in this scan and will be retried: %s",
+		len(failures), strings.Join(replayNames, ", ")))}
+}
+
+// keepWatchingAfterUploadFailures returns nil for the failed uploads of a scan with ContinueOnError, so
+// the watch loop carries on and retries them, and any other error as it is.
+func keepWatchingAfterUploadFailures(err error, config *Config) error {
+	var uploadErr *UploadError
+	if config.ContinueOnError && errors.As(err, &uploadErr) {
+		logErrorf("%s", err)
+		return nil
+	}
+
+	return err
+}
+
+// minBatchReady reports whether there are at least MinBatchSize pending replays, or whether the oldest of
+// them was written more than MinBatchMaxWaitSeconds ago and the batch should be posted regardless.
+func minBatchReady(pendingPaths []string, now time.Time, config *Config) bool {
+	if len(pendingPaths) >= config.MinBatchSize {
+		return true
+	}
+
+	if config.MinBatchMaxWaitSeconds > 0 {
+		for _, pendingPath := range pendingPaths {
+			if info, err := os.Stat(pendingPath); err == nil && now.Sub(info.ModTime()) >= time.Duration(config.MinBatchMaxWaitSeconds)*time.Second {
+				logInfof("Replay '%s' has waited over %d seconds for a full batch, posting the %d pending replay(s) anyway",
+					pendingPath, config.MinBatchMaxWaitSeconds, len(pendingPaths))
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// replayDirectoryError returns an error if ReplayDirectoryPath doesn't exist or isn't a directory, e.g.
+// because the drive it's on was unmounted.
+func replayDirectoryError(config *Config) error {
+	if info, err := os.Stat(config.ReplayDirectoryPath); err != nil {
+		return &ReplayDirectoryError{errors.New(fmt.Sprintf("Replay directory '%s' is unavailable: %s", config.ReplayDirectoryPath, err))}
+	} else if !info.IsDir() {
+		return &ReplayDirectoryError{errors.New(fmt.Sprintf("Replay directory '%s' is not a directory", config.ReplayDirectoryPath))}
 	}
 
 	return nil
 }
 
-func checkResponseOk(responseBody io.ReadCloser) error {
-	bodyJsonString, err := ioutil.ReadAll(responseBody)
+// findPendingReplays returns the replays in the replay directory that pass the configured filters,
+// haven't been uploaded yet and have finished being written, in upload order.
+func findPendingReplays(db *sql.DB, config *Config, state *ScanState) ([]string, error) {
+	replayPaths, err := filepath.Glob(filepath.Join(config.ReplayDirectoryPath, config.ReplayGlob))
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	var responseBodyObj ResponseBody
+	if config.UploadOrder == UPLOAD_ORDER_MTIME {
+		sortReplayPathsByModTime(replayPaths)
+	}
+	defer state.debouncer.prune(replayPaths)
 
-	err = json.Unmarshal([]byte(bodyJsonString), &responseBodyObj)
+	pendingPaths := make([]string, 0)
+	for _, replayFilePath := range replayPaths {
+		if eligible, err := replayEligible(replayFilePath, false, db, config, state); err != nil {
+			return nil, err
+		} else if eligible {
+			pendingPaths = append(pendingPaths, replayFilePath)
+		}
+	}
+
+	return pendingPaths, nil
+}
+
+// replayEligible reports whether a replay should be uploaded now: it passes the configured filters,
+// hasn't been uploaded yet and has finished being written. Replays that failed to upload are left to
+// retryFailedReplays if FailedRetryIntervalSeconds is set, unless retrying is true because it's the one
+// asking.
+func replayEligible(replayFilePath string, retrying bool, db *sql.DB, config *Config, state *ScanState) (bool, error) {
+	replayName := filepath.Base(replayFilePath)
+
+	if include, err := replayNameIncluded(replayName, config); err != nil {
+		return false, err
+	} else if !include {
+		return false, nil
+	}
+
+	if config.excludeRegexp != nil && config.excludeRegexp.MatchString(replayName) {
+		logDebugf("Skipping replay '%s' because it matches ExcludePattern", replayFilePath)
+		return false, nil
+	}
+
+	if !replayExtensionAllowed(replayName, config) {
+		logDebugf("Skipping replay '%s' because of its extension", replayFilePath)
+		return false, nil
+	}
+
+	if tempFile, err := replayBeingRenamed(replayFilePath, config); err != nil {
+		return false, err
+	} else if tempFile != "" {
+		logDebugf("Skipping replay '%s' because temporary file '%s' is still there", replayFilePath, tempFile)
+		return false, nil
+	}
+
+	status, err := replayQueueStatus(replayName, db)
 	if err != nil {
-		log.Printf("Error parsing JSON response body: %s", bodyJsonString)
-		return err
+		return false, &DatabaseError{err}
+	} else if status == QUEUE_STATUS_DENIED {
+		return false, nil
+	} else if status == QUEUE_STATUS_FAILED && config.FailedRetryIntervalSeconds > 0 && !retrying {
+		logDebugf("Skipping replay '%s' because it failed to upload, it'll be retried on the FailedRetryIntervalSeconds schedule", replayFilePath)
+		return false, nil
 	}
 
-	if responseBodyObj.Ok != true {
-		return errors.New(fmt.Sprintf("Error uploading replay: %s", responseBodyObj.Error))
+	if replayNameDenied(replayName, config) {
+		logDebugf("Skipping replay '%s' because it's listed in DenyFilenames", replayFilePath)
+		if config.RecordDeniedFilenames {
+			if err := markReplayDenied(replayName, db); err != nil {
+				return false, &DatabaseError{err}
+			}
+			writeAuditEvent(AUDIT_EVENT_SKIPPED, replayName, "", "listed in DenyFilenames", config)
+		}
+		return false, nil
 	}
 
-	return nil
+	dedupKey, err := replayDedupKey(replayFilePath, config)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	if diskSpace.isUnrecorded(dedupKey) {
+		return false, nil
+	}
+
+	if replayUploaded, uploadedCheckError := replayPosted(replayName, dedupKey, db, config); uploadedCheckError != nil {
+		return false, &DatabaseError{uploadedCheckError}
+	} else if replayUploaded {
+		return false, nil
+	}
+
+	// a dead-lettered replay had finished being written before its first attempt, and nothing writes to DeadLetterDir
+	if status == QUEUE_STATUS_DEAD_LETTERED {
+		return true, nil
+	}
+
+	if settled, err := replaySettled(replayFilePath, config, state); os.IsNotExist(err) {
+		logWarnf("replay '%s' disappeared before it could be uploaded, skipping it", replayFilePath)
+		return false, nil
+	} else if err != nil {
+		return false, err
+	} else if !settled {
+		logDebugf("Replay '%s' is still being written, waiting for it to settle", replayFilePath)
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// replaySettled reports whether a replay has finished being written, going by SettleMode.
+func replaySettled(replayFilePath string, config *Config, state *ScanState) (bool, error) {
+	if config.SettleMode == SETTLE_MODE_SIZE {
+		return state.debouncer.sizeStable(replayFilePath)
+	}
+
+	return state.debouncer.settled(replayFilePath, time.Duration(config.DebounceSeconds)*time.Second)
+}
+
+// replayBeingRenamed returns the temporary file, by TempFileSuffixes, that shows a replay is still being
+// written: the replay itself if it has a temporary name, so it's only ever posted under its final one,
+// or a sibling such as "foo.gif.tmp" that the tool writing "foo.gif" hasn't finished with yet.
+func replayBeingRenamed(replayFilePath string, config *Config) (string, error) {
+	for _, suffix := range config.TempFileSuffixes {
+		if strings.HasSuffix(strings.ToLower(replayFilePath), strings.ToLower(suffix)) {
+			return replayFilePath, nil
+		}
+
+		tempFilePath := replayFilePath + suffix
+		if _, err := os.Stat(tempFilePath); err == nil {
+			return tempFilePath, nil
+		} else if !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+
+	return "", nil
+}
+
+// replayExtensionAllowed applies the configured IncludeExtensions and IgnoreExtensions to a replay's
+// file name, case-insensitively. Extensions may span several dots, e.g. ".gif.part".
+func replayExtensionAllowed(replayName string, config *Config) bool {
+	hasExtension := func(extension string) bool {
+		if !strings.HasPrefix(extension, ".") {
+			extension = "." + extension
+		}
+		return strings.HasSuffix(strings.ToLower(replayName), strings.ToLower(extension))
+	}
+
+	for _, extension := range config.IgnoreExtensions {
+		if hasExtension(extension) {
+			return false
+		}
+	}
+
+	if len(config.IncludeExtensions) == 0 {
+		return true
+	}
+
+	for _, extension := range config.IncludeExtensions {
+		if hasExtension(extension) {
+			return true
+		}
+	}
+
+	return false
 }
 
-func checkReplayAlreadyUploaded(fileName string, db *sql.DB) (bool, error) {
-	stmnt, err := db.Prepare("SELECT COUNT(*) FROM posted_replays WHERE replay_file_name = ?")
-	defer stmnt.Close()
+// uploadAndRecordReplay uploads a single pending replay, optionally as a reply in the thread started by
+// threadTs, and records it as uploaded. It returns the id of the message the replay was shared in, when
+// the target reports one.
+func uploadAndRecordReplay(ctx context.Context, replayFilePath string, threadTs string, db *sql.DB, config *Config) (string, error) {
+	replayName := filepath.Base(replayFilePath)
 
+	if err := enqueueReplay(replayName, db); err != nil {
+		return "", &DatabaseError{err}
+	}
+
+	uploadedCount, err := countUploadedReplays(db)
 	if err != nil {
-		log.Printf("Error preparing database statement: %s", err)
-		return false, err
+		return "", &DatabaseError{err}
 	}
 
-	var count int
-	err = stmnt.QueryRow(fileName).Scan(&count)
+	result, err := prepareAndUploadReplay(ctx, replayFilePath, threadTs, uploadedCount+1, db, config)
+	if err != nil {
+		return "", handleReplayUploadFailure(ctx, replayFilePath, err, db, config)
+	}
+
+	if err := recordReplayUploaded(replayFilePath, result.FileId, db, config); err != nil {
+		return "", err
+	}
+
+	return result.ThreadId, nil
+}
+
+// handleReplayUploadFailure deals with a replay that failed to upload: a replay that has disappeared is
+// forgotten, and any other is marked failed and dead-lettered once it has run out of attempts. It
+// returns the error that should stop the scan, if any.
+func handleReplayUploadFailure(ctx context.Context, replayFilePath string, err error, db *sql.DB, config *Config) error {
+	replayName := filepath.Base(replayFilePath)
+
+	if os.IsNotExist(err) {
+		// deleted or moved by something else since the scan found it; it'll be picked up again if it comes back
+		logWarnf("replay '%s' disappeared before it could be uploaded, skipping it", replayFilePath)
+		writeAuditEvent(AUDIT_EVENT_SKIPPED, replayName, "", "disappeared before it could be uploaded", config)
+		if queueErr := dequeueReplay(replayName, db); queueErr != nil {
+			logErrorf("%s", queueErr)
+		}
+		return nil
+	} else if ctx.Err() != nil {
+		// the scan was cancelled rather than the upload failing, so leave the replay for the next scan
+		return err
+	}
+
+	if queueErr := markReplayFailed(replayName, err, db); queueErr != nil {
+		logErrorf("%s", queueErr)
+	}
+	writeAuditEvent(AUDIT_EVENT_FAILED, replayName, "", err.Error(), config)
+
+	deadLettered, deadLetterErr := deadLetterIfExhausted(replayFilePath, db, config)
+	if deadLetterErr != nil {
+		logErrorf("Error moving replay '%s' to the dead-letter directory: %s", replayFilePath, deadLetterErr)
+	}
+	if deadLettered || uploadAttemptsExhausted(replayName, db, config) {
+		runFailureCommand(replayFilePath, err, config)
+	}
+	opsAlerts.recordFailure(replayFilePath, err, deadLettered, config)
 
+	if deadLettered {
+		// the replay is out of the way now, so carry on with the rest
+		logErrorf("Error uploading replay '%s': %s", replayFilePath, err)
+		writeAuditEvent(AUDIT_EVENT_SKIPPED, replayName, "", "moved to DeadLetterDir", config)
+		return nil
+	}
+
+	return &UploadError{replayFilePath, err}
+}
+
+// uploadAttemptsExhausted reports whether a replay that just failed to upload has used up its
+// MaxUploadAttempts. Without a limit, every failure counts as its last.
+func uploadAttemptsExhausted(replayName string, db *sql.DB, config *Config) bool {
+	if config.MaxUploadAttempts <= 0 {
+		return true
+	}
+
+	attempts, err := replayUploadAttempts(replayName, db)
 	if err != nil {
-		return false, err
-	} else {
-		return count != 0, nil
+		logErrorf("%s", err)
+		return false
 	}
+
+	return attempts == config.MaxUploadAttempts
 }
 
-func recordReplayWasUploaded(replayFileName string, db *sql.DB) error {
-	stmnt, err := db.Prepare("INSERT INTO posted_replays VALUES(?);")
-	defer stmnt.Close()
+// recordReplayUploaded records that a replay was posted as the file fileId, and runs everything that
+// follows a successful upload.
+func recordReplayUploaded(replayFilePath string, fileId string, db *sql.DB, config *Config) error {
+	replayName := filepath.Base(replayFilePath)
 
+	logInfof("Uploaded replay '%s'", replayFilePath)
+	dedupKey, err := replayDedupKey(replayFilePath, config)
 	if err != nil {
-		return errors.New(fmt.Sprintf("Error recording that replay '%s' was uploaded: %s", replayFileName, err))
-	} else {
-		if _, err := stmnt.Exec(replayFileName); err != nil {
-			return errors.New(fmt.Sprintf("Error recording that replay '%s' was uploaded: %s", replayFileName, err))
+		logErrorf("Error working out the checksum of replay '%s', recording it by name instead: %s", replayFilePath, err)
+		dedupKey = replayName
+	}
+
+	err = retryRecordWrite(config, func() error { return newDedupStore(db, config).markUploaded(dedupKey) })
+	if diskFull(err) {
+		// the replay has been posted, so it mustn't be posted again before this can be recorded
+		diskSpace.addUnrecorded(dedupKey, replayName)
+		return err
+	} else if err != nil {
+		logErrorf("CRITICAL: replay '%s' was posted to channel '%s' but couldn't be recorded as uploaded, so it will be posted again; delete the duplicate from the channel: %s",
+			replayFilePath, config.ChannelID, err)
+		return &DatabaseError{err}
+	}
+	if err := retryRecordWrite(config, func() error { return markReplayDone(replayName, db) }); err != nil {
+		return &DatabaseError{err}
+	}
+	writeAuditEvent(AUDIT_EVENT_UPLOADED, replayName, fileId, "", config)
+	opsAlerts.recordSuccess(config)
+
+	if config.OnUploadWebhook != "" {
+		if err := postUploadWebhook(replayName, fileId, config); err != nil {
+			logErrorf("Error calling OnUploadWebhook for replay '%s': %s", replayFilePath, err)
 		}
 	}
 
+	runAfterUpload(replayFilePath, replayName, db, config)
+
 	return nil
 }
 
-func initializeDbIfNotExist(dbPath string) error {
-	if !fileExists(dbPath) {
-		db, err := sql.Open("sqlite3", dbPath)
-		defer db.Close()
-
-		if err != nil {
-			return err
-		} else {
-			_, err := db.Exec("CREATE TABLE posted_replays(replay_file_name varchar(512));")
-			if err != nil {
-				return err
-			}
+// sortReplayPathsByModTime sorts replay paths oldest-first, breaking ties by name. Replays that can't
+// be stat'ed sort first and are dealt with when they're uploaded.
+func sortReplayPathsByModTime(replayPaths []string) {
+	modTimes := make(map[string]time.Time, len(replayPaths))
+	for _, replayPath := range replayPaths {
+		if info, err := os.Stat(replayPath); err == nil {
+			modTimes[replayPath] = info.ModTime()
 		}
+	}
 
+	sort.SliceStable(replayPaths, func(i, j int) bool {
+		return modTimes[replayPaths[i]].Before(modTimes[replayPaths[j]])
+	})
+}
+
+// replayNameDenied reports whether a replay's file name is listed in DenyFilenames.
+func replayNameDenied(replayName string, config *Config) bool {
+	for _, deniedName := range config.DenyFilenames {
+		if replayName == deniedName {
+			return true
+		}
 	}
 
-	return nil
+	return false
 }
 
-type ResponseBody struct {
-	Ok    bool
-	Error string
+// replayNameIncluded applies the configured IncludeGlobs and ExcludeGlobs to a replay's file name.
+// An empty IncludeGlobs list includes everything; a matching exclude always wins over an include.
+func replayNameIncluded(replayName string, config *Config) (bool, error) {
+	for _, pattern := range config.ExcludeGlobs {
+		if matched, err := filepath.Match(pattern, replayName); err != nil {
+			return false, errors.New(fmt.Sprintf("Invalid exclude glob '%s': %s", pattern, err))
+		} else if matched {
+			return false, nil
+		}
+	}
+
+	if len(config.IncludeGlobs) == 0 {
+		return true, nil
+	}
+
+	for _, pattern := range config.IncludeGlobs {
+		if matched, err := filepath.Match(pattern, replayName); err != nil {
+			return false, errors.New(fmt.Sprintf("Invalid include glob '%s': %s", pattern, err))
+		} else if matched {
+			return true, nil
+		}
+	}
+
+	return false, nil
 }
 
-type Config struct {
-	ReplayDirectoryPath string
-	AuthToken           string
-	ChannelID           string
+func prepareAndUploadReplay(ctx context.Context, replayFilePath string, threadTs string, replayIndex int, db *sql.DB, config *Config) (*UploadResult, error) {
+	upload, cleanup := prepareReplayUpload(replayFilePath, threadTs, replayIndex, config)
+	defer cleanup()
+
+	return newUploader(config).upload(ctx, upload, db, config)
 }
 
-func readConfig(confFilePath string) (*Config, error) {
-	if confBytes, err := ioutil.ReadFile(confFilePath); err != nil {
-		return nil, err
-	} else {
-		conf := new(Config)
-		err = json.Unmarshal(confBytes, conf)
+// prepareReplayUpload works out how a replay is to be posted: its message, the name to post it under,
+// its thumbnail and, with OptimizeGifs, the optimized copy to send instead. The returned cleanup function
+// removes any temp files once the upload is over.
+func prepareReplayUpload(replayFilePath string, threadTs string, replayIndex int, config *Config) (*ReplayUpload, func()) {
+	cleanup := func() {}
+	replayName := filepath.Base(replayFilePath)
+	upload := &ReplayUpload{FilePath: replayFilePath, ReplayName: replayName, FileName: replayName, ThreadTs: threadTs}
+	metadata, metadataMatched := replayMetadata(replayFilePath, replayIndex, config)
+	upload.Metadata = metadata
+	upload.Unshared = config.MessageFormat == MESSAGE_FORMAT_BLOCKS
 
-		if err != nil {
-			return nil, err
-		} else {
-			return conf, nil
+	if config.MessageTemplate != "" {
+		upload.InitialComment = renderReplayTemplate(config.MessageTemplate, metadata, metadataMatched, config)
+	}
+
+	if config.MatchComment {
+		if matchComment := renderMatchComment(metadata, metadataMatched, config); matchComment != "" {
+			upload.InitialComment = strings.TrimSpace(upload.InitialComment + "\n" + matchComment)
 		}
 	}
+
+	if config.ShowFileDate {
+		if info, err := os.Stat(replayFilePath); err != nil {
+			logWarnf("couldn't read the modification time of replay '%s', posting it without its date: %s", replayFilePath, err)
+		} else {
+			upload.InitialComment = strings.TrimSpace(upload.InitialComment + "\n" + renderFileDate(info.ModTime(), config))
+		}
+	}
+
+	// the name shown in Slack is only cosmetic; replays are still deduplicated by their name on disk, or checksum
+	if config.SlackFilenameTemplate != "" {
+		upload.FileName = renderReplayTemplate(config.SlackFilenameTemplate, metadata, metadataMatched, config)
+	} else if config.slackFilenameRegexp != nil {
+		upload.FileName = config.slackFilenameRegexp.ReplaceAllString(upload.FileName, config.SlackFilenameReplacement)
+	}
+
+	if config.TitleTemplate != "" {
+		upload.Title = renderReplayTemplate(config.TitleTemplate, metadata, metadataMatched, config)
+	}
+
+	if config.IncludeChecksumInTitle {
+		if checksum, err := replayChecksums.sha256(replayFilePath); err != nil {
+			logErrorf("Error working out the checksum of replay '%s', uploading without it: %s", replayFilePath, err)
+		} else if upload.Title != "" {
+			upload.Title = fmt.Sprintf("%s sha256:%s", upload.Title, checksum)
+		} else {
+			upload.Title = fmt.Sprintf("%s sha256:%s", upload.FileName, checksum)
+		}
+	}
+
+	if config.AttachThumbnail {
+		if thumbnail, err := renderThumbnail(replayFilePath); err != nil {
+			logErrorf("Error rendering a thumbnail for replay '%s', uploading without one: %s", replayFilePath, err)
+		} else {
+			upload.Thumbnail = thumbnail
+		}
+	}
+
+	if config.OptimizeGifs {
+		if optimizedPath, err := optimizeReplay(replayFilePath, config); diskFull(err) {
+			diskSpace.reportFull(config.TempDir, err)
+			logErrorf("Error optimizing replay '%s', uploading the original instead: %s", replayFilePath, err)
+		} else if err != nil {
+			logErrorf("Error optimizing replay '%s', uploading the original instead: %s", replayFilePath, err)
+		} else if optimizedPath != "" {
+			diskSpace.reportOk(config.TempDir)
+			cleanup = func() { os.Remove(optimizedPath) }
+			upload.FilePath = optimizedPath
+		}
+	}
+
+	return upload, cleanup
+}
+
+func uploadReplay(ctx context.Context, upload *ReplayUpload, config *Config) (responseBody *ResponseBody, err error) {
+	replayFilePath := upload.FilePath
+	logInfof("Uploading replay '%s'", replayFilePath)
+
+	ctx, span := startSpan(ctx, "files.upload", SPAN_KIND_CLIENT)
+	defer func() { span.end(err) }()
+	span.setAttribute("replay.filename", upload.FileName)
+	span.setAttribute("slack.channel", config.ChannelID)
+
+	fh, err := os.Open(replayFilePath)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	var replayFile io.Reader = fh
+	if info, err := fh.Stat(); err == nil {
+		span.setAttribute("replay.size", info.Size())
+		replayFile = newProgressReader(fh, info.Size(), replayFilePath, config)
+	}
+
+	bodyReader, contentType := streamReplayMultipartBody(replayFile, upload, config)
+	countingBody := &CountingReader{reader: bodyReader}
+
+	req, err := http.NewRequestWithContext(ctx, config.UploadHttpMethod, slackApiUrl("files.upload", config), countingBody)
+	if err != nil {
+		bodyReader.CloseWithError(err)
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if config.GzipUploads {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+
+	started := time.Now()
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		bodyReader.CloseWithError(err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+	logDebugf("Uploaded replay '%s': %s", replayFilePath, formatThroughput(countingBody.readBytes, time.Since(started)))
+
+	if resp.StatusCode != http.StatusOK {
+		snippet, _ := readResponseSnippet(resp.Body)
+		return nil, errors.New(fmt.Sprintf("Error uploading replay '%s': %d: %s", replayFilePath, resp.StatusCode, snippet))
+	}
+
+	return checkResponseOk(resp.StatusCode, resp.Body)
+}
+
+// slackApiUrl returns the endpoint of a Slack Web API method under the configured base URL.
+func slackApiUrl(method string, config *Config) string {
+	return strings.TrimRight(config.SlackApiBaseUrl, "/") + "/api/" + method
+}
+
+// streamReplayMultipartBody returns a reader of the multipart body for an upload, along with its content
+// type. The body is written by a goroutine through a pipe as it's read, so the replay is never held in
+// memory in full.
+func streamReplayMultipartBody(replayFile io.Reader, upload *ReplayUpload, config *Config) (*io.PipeReader, string) {
+	bodyReader, bodyPipeWriter := io.Pipe()
+
+	var partsWriter io.Writer = bodyPipeWriter
+	var gzipWriter *gzip.Writer
+	if config.GzipUploads {
+		gzipWriter = gzip.NewWriter(bodyPipeWriter)
+		partsWriter = gzipWriter
+	}
+
+	bodyWriter := multipart.NewWriter(partsWriter)
+
+	go func() {
+		err := writeReplayMultipartBody(bodyWriter, replayFile, upload, config)
+		if err == nil && gzipWriter != nil {
+			err = gzipWriter.Close()
+		}
+		bodyPipeWriter.CloseWithError(err)
+	}()
+
+	return bodyReader, bodyWriter.FormDataContentType()
+}
+
+func writeReplayMultipartBody(bodyWriter *multipart.Writer, replayFile io.Reader, upload *ReplayUpload, config *Config) error {
+	replayFileName := upload.FileName
+
+	fileWriter, err := bodyWriter.CreateFormFile(multipartFieldName("file", config), replayFileName)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(fileWriter, replayFile); err != nil {
+		return err
+	}
+
+	// add the first-frame preview, if one was rendered
+	if upload.Thumbnail != nil {
+		thumbWriter, err := bodyWriter.CreateFormFile("thumb", strings.TrimSuffix(replayFileName, filepath.Ext(replayFileName))+".png")
+		if err != nil {
+			return err
+		}
+
+		if _, err := thumbWriter.Write(upload.Thumbnail); err != nil {
+			return err
+		}
+	}
+
+	// add the auth token
+	if err := bodyWriter.WriteField(multipartFieldName("token", config), config.AuthToken); err != nil {
+		return err
+	}
+
+	// add the filename
+	if err := bodyWriter.WriteField(multipartFieldName("filename", config), replayFileName); err != nil {
+		return err
+	}
+
+	// add the title, if it differs from the filename
+	if upload.Title != "" {
+		if err := bodyWriter.WriteField("title", upload.Title); err != nil {
+			return err
+		}
+	}
+
+	// a file posted as part of a Block Kit message is only uploaded here
+	if upload.Unshared {
+		if err := writeExtraFormFields(bodyWriter, upload, config); err != nil {
+			return err
+		}
+		return bodyWriter.Close()
+	}
+
+	// add the message to post along with the replay
+	if upload.InitialComment != "" {
+		if err := bodyWriter.WriteField("initial_comment", upload.InitialComment); err != nil {
+			return err
+		}
+	}
+
+	// add the channel to post this to; Slack rejects a thread_ts sent along with the plural "channels"
+	channelField := "channels"
+	if upload.ThreadTs != "" {
+		channelField = "channel"
+	}
+	if err := bodyWriter.WriteField(multipartFieldName(channelField, config), config.ChannelID); err != nil {
+		return err
+	}
+
+	// reply in a thread, if this replay is part of a bundle being threaded
+	if upload.ThreadTs != "" {
+		if err := bodyWriter.WriteField("thread_ts", upload.ThreadTs); err != nil {
+			return err
+		}
+	}
+
+	if err := writeExtraFormFields(bodyWriter, upload, config); err != nil {
+		return err
+	}
+
+	return bodyWriter.Close()
+}
+
+// The multipart fields files.upload uploads always send, which ExtraFormFields can't add to.
+var RESERVED_FORM_FIELDS = []string{"file", "thumb", "token", "filename", "channels", "channel", "thread_ts"}
+
+// writeExtraFormFields adds the ExtraFormFields, in name order, with the replay's template values
+// substituted. A title or initial_comment is only added when the uploader isn't sending its own.
+func writeExtraFormFields(bodyWriter *multipart.Writer, upload *ReplayUpload, config *Config) error {
+	names := make([]string, 0, len(config.ExtraFormFields))
+	for name := range config.ExtraFormFields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if (name == "title" && upload.Title != "") || (name == "initial_comment" && upload.InitialComment != "" && !upload.Unshared) {
+			continue
+		}
+
+		if err := bodyWriter.WriteField(name, renderTemplate(config.ExtraFormFields[name], upload.Metadata)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// The files.upload multipart fields whose names can be overridden with MultipartFieldNames, for
+// Slack-compatible services that expect different ones.
+var MULTIPART_FIELDS = []string{"file", "token", "filename", "channels", "channel"}
+
+// multipartFieldName returns the name to send a files.upload multipart field under.
+func multipartFieldName(field string, config *Config) string {
+	if name, ok := config.MultipartFieldNames[field]; ok {
+		return name
+	}
+
+	return field
+}
+
+// The most of a response body that's read, so that a huge error page can't exhaust memory or the logs,
+// and the most of one that's quoted in an error.
+const MAX_RESPONSE_BODY_BYTES int64 = 64 * 1024
+const RESPONSE_SNIPPET_CHARS int = 200
+
+// readResponseSnippet reads the start of a response body that's only needed for an error message.
+func readResponseSnippet(responseBody io.Reader) (string, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(responseBody, MAX_RESPONSE_BODY_BYTES))
+	return truncateSnippet(string(body)), err
+}
+
+// truncateSnippet shortens a response body to RESPONSE_SNIPPET_CHARS on one line, for an error message.
+func truncateSnippet(body string) string {
+	snippet := strings.Join(strings.Fields(body), " ")
+	if runes := []rune(snippet); len(runes) > RESPONSE_SNIPPET_CHARS {
+		snippet = string(runes[:RESPONSE_SNIPPET_CHARS]) + "..."
+	}
+
+	return fmt.Sprintf("%q", snippet)
+}
+
+func checkResponseOk(statusCode int, responseBody io.Reader) (*ResponseBody, error) {
+	bodyJsonString, err := ioutil.ReadAll(io.LimitReader(responseBody, MAX_RESPONSE_BODY_BYTES))
+	if err != nil {
+		return nil, err
+	}
+
+	var responseBodyObj ResponseBody
+
+	err = json.Unmarshal([]byte(bodyJsonString), &responseBodyObj)
+	if err != nil {
+		// e.g. an HTML error page from a proxy in front of Slack
+		return nil, errors.New(fmt.Sprintf("Error parsing the response to the upload (HTTP %d) as JSON: %s: %s", statusCode, err,
+			truncateSnippet(string(bodyJsonString))))
+	}
+
+	responseBodyObj.logWarning()
+
+	if responseBodyObj.Ok != true {
+		return nil, &SlackApiError{responseBodyObj.Error, errors.New(fmt.Sprintf("Error uploading replay: %s",
+			slackErrorDetail(responseBodyObj.Error, responseBodyObj.Needed, responseBodyObj.Provided)))}
+	}
+
+	return &responseBodyObj, nil
+}
+
+// checkReplayAlreadyUploaded reports whether a replay was already posted to the configured channel, or
+// runs DedupSelectSql with just the file name if it's set.
+func checkReplayAlreadyUploaded(fileName string, db *sql.DB, config *Config) (bool, error) {
+	query, args := DEDUP_SELECT_SQL, []interface{}{fileName, config.ChannelID}
+	if config.DedupSelectSql != "" {
+		query, args = config.DedupSelectSql, []interface{}{fileName}
+	}
+
+	var count int
+	err := retryDbBusy(config, func() error {
+		stmnt, err := db.Prepare(query)
+		if err != nil {
+			logErrorf("Error preparing database statement: %s", err)
+			return err
+		}
+		defer stmnt.Close()
+
+		return stmnt.QueryRow(args...).Scan(&count)
+	})
+
+	if err != nil {
+		return false, err
+	} else {
+		return count != 0, nil
+	}
+}
+
+func countUploadedReplays(db *sql.DB) (int, error) {
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM posted_replays").Scan(&count); err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// recordReplayWasUploaded records that a replay was posted to the configured channel and target, or runs
+// DedupInsertSql with just the file name if it's set.
+func recordReplayWasUploaded(replayFileName string, db *sql.DB, config *Config) error {
+	query, args := DEDUP_INSERT_SQL, []interface{}{replayFileName, config.ChannelID, config.Target}
+	if config.DedupInsertSql != "" {
+		query, args = config.DedupInsertSql, []interface{}{replayFileName}
+	}
+
+	err := retryDbBusy(config, func() error {
+		stmnt, err := db.Prepare(query)
+		if err != nil {
+			return err
+		}
+		defer stmnt.Close()
+
+		_, err = stmnt.Exec(args...)
+		return err
+	})
+	if diskFull(err) {
+		return &DiskFullError{config.DatabasePath, err}
+	} else if err != nil {
+		return errors.New(fmt.Sprintf("Error recording that replay '%s' was uploaded: %s", replayFileName, err))
+	}
+
+	return nil
+}
+
+// openDb opens the sqlite database in WAL mode with a busy timeout, so that concurrent readers and
+// writers wait for each other rather than failing with "database is locked".
+func openDb(dbPath string, config *Config) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", fmt.Sprintf("%s?_journal_mode=WAL&_busy_timeout=%d", dbPath, config.DbBusyTimeoutMs))
+	if err != nil {
+		return nil, err
+	}
+
+	db.SetMaxOpenConns(config.DbMaxOpenConns)
+	db.SetMaxIdleConns(config.DbMaxOpenConns)
+
+	return db, nil
+}
+
+func initializeDbIfNotExist(dbPath string, config *Config) error {
+	db, err := openDb(dbPath, config)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return initializeDb(db, config)
+}
+
+// initializeDb creates the tables of a new database, or brings those of an existing one up to date.
+func initializeDb(db *sql.DB, config *Config) error {
+	return migrateDb(db, config)
+}
+
+// migratePostedReplaysChannel adds the channel_id and target columns to a posted_replays table created
+// before replays were recorded per channel. Replays recorded until now are attributed to the configured
+// channel and target, since that's where they would have been posted.
+func migratePostedReplaysChannel(db *sql.DB, config *Config) error {
+	if columns, err := tableColumns(db, "posted_replays"); err != nil {
+		return err
+	} else if columns["channel_id"] {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, statement := range []string{
+		"ALTER TABLE posted_replays ADD COLUMN channel_id varchar(64) NOT NULL DEFAULT '';",
+		"ALTER TABLE posted_replays ADD COLUMN target varchar(16) NOT NULL DEFAULT '';",
+	} {
+		if _, err := tx.Exec(statement); err != nil {
+			return err
+		}
+	}
+
+	if result, err := tx.Exec("UPDATE posted_replays SET channel_id = ?, target = ?;", config.ChannelID, config.Target); err != nil {
+		return err
+	} else if migrated, err := result.RowsAffected(); err == nil {
+		logInfof("Recorded %d previously posted replay(s) as posted to channel '%s'", migrated, config.ChannelID)
+	}
+
+	return tx.Commit()
+}
+
+// ReplayUpload describes a single file to post: the path of the bytes to send, the replay's name on
+// disk, the name to post it under, and an optional PNG preview.
+type ReplayUpload struct {
+	FilePath       string
+	ReplayName     string
+	FileName       string
+	Thumbnail      []byte
+	InitialComment string
+	ThreadTs       string
+
+	// Title is the title to show in Slack, if it should be something other than FileName.
+	Title string
+
+	// Metadata holds the replay's template values, and Unshared uploads the file without posting it to
+	// the channel, for when it's posted as part of a Block Kit message instead.
+	Metadata map[string]string
+	Unshared bool
+}
+
+type ResponseBody struct {
+	Ok       bool
+	Error    string
+	Warning  string
+	Needed   string
+	Provided string
+	File     ResponseFile
+	Files    []ResponseFile
+}
+
+type ResponseFile struct {
+	Id         string
+	Permalink  string
+	UrlPrivate string `json:"url_private"`
+	Shares     struct {
+		Public  map[string][]ResponseShare
+		Private map[string][]ResponseShare
+	}
+}
+
+type ResponseShare struct {
+	Ts string
+}
+
+// SlackApiError is a request the Slack Web API answered with an error code, e.g. "not_in_channel".
+type SlackApiError struct {
+	Code string
+	err  error
+}
+
+func (e *SlackApiError) Error() string { return e.err.Error() }
+func (e *SlackApiError) Unwrap() error { return e.err }
+
+// slackErrorDetail describes a Slack error code along with the scopes Slack reports as needed and
+// provided for permission errors, e.g. "missing_scope (needed: files:write, provided: chat:write)".
+func slackErrorDetail(errorCode string, needed string, provided string) string {
+	if needed == "" && provided == "" {
+		return errorCode
+	}
+
+	return fmt.Sprintf("%s (needed: %s, provided: %s)", errorCode, needed, provided)
+}
+
+// logWarning logs the warning Slack attached to a response, if any. Slack warns about things like
+// missing charsets even when a request succeeds.
+func (r *ResponseBody) logWarning() {
+	if r.Warning != "" {
+		logWarnf("Slack responded with warning '%s'", r.Warning)
+	}
+}
+
+// shareTs returns the timestamp of the message the uploaded file was shared in on the given channel,
+// or "" if Slack didn't report one.
+func (r *ResponseBody) shareTs(channelID string) string {
+	if shares := r.File.Shares.Public[channelID]; len(shares) > 0 {
+		return shares[0].Ts
+	}
+	if shares := r.File.Shares.Private[channelID]; len(shares) > 0 {
+		return shares[0].Ts
+	}
+
+	return ""
+}
+
+type Config struct {
+	ReplayDirectoryPath string
+	ReplayGlob          string
+	DatabasePath        string
+	AuthToken           string
+	AuthTokenFile       string
+	ChannelID           string
+	AutoJoinChannel     bool
+
+	OpsChannelID               string
+	OpsAlertFailureStreak      int
+	OpsAlertMinIntervalSeconds int
+	Target                     string
+	SlackApiBaseUrl            string
+	UploadMethod               string
+	GzipUploads                bool
+	MultipartFieldNames        map[string]string
+	ExtraFormFields            map[string]string
+	UploadHttpMethod           string
+	MaxConnsPerHost            int
+	MaxIdleConnsPerHost        int
+	MaxConcurrentRequests      int
+
+	MattermostURL   string
+	MattermostToken string
+
+	ExternalUploadChunkBytes  int
+	ProgressLogThresholdBytes int
+
+	IncludeGlobs      []string
+	ExcludeGlobs      []string
+	ExcludePattern    string
+	IncludeExtensions []string
+	IgnoreExtensions  []string
+	TempFileSuffixes  []string
+
+	DenyFilenames         []string
+	RecordDeniedFilenames bool
+
+	OptimizeGifs           bool
+	IncludeChecksumInTitle bool
+	OptimizeGifFrameStep   int
+	OptimizeGifMaxColors   int
+	OptimizeGifTargetBytes int
+
+	TempDir string
+
+	AttachThumbnail bool
+
+	FilenameMetadataPattern  string
+	MessageTemplate          string
+	MessageFormat            string
+	BatchUpload              bool
+	BlocksTemplate           string
+	MatchComment             bool
+	ShowFileDate             bool
+	FileDateLayout           string
+	FileDateTimeZone         string
+	SlackFilenameTemplate    string
+	TitleTemplate            string
+	SlackFilenamePattern     string
+	SlackFilenameReplacement string
+
+	CheckIntervalSeconds       int
+	ScanOnStartup              bool
+	CheckIntervalJitterPercent int
+	CheckIntervalJitterSeconds int
+	ScanTimeoutSeconds         int
+	UploadOrder                string
+	MissingDirectoryPolicy     string
+	DebounceSeconds            int
+	SettleMode                 string
+
+	MaxUploadsPerCycle  int
+	UploadsPerMinute    int
+	MaxUploadsPerMinute int
+
+	BundleWindowSeconds int
+	BundleThread        bool
+
+	MinBatchSize           int
+	MinBatchMaxWaitSeconds int
+
+	DigestMode        bool
+	DigestTime        string
+	DigestIdleMinutes int
+
+	DbMaxOpenConns     int
+	DbBusyTimeoutMs    int
+	DbBusyRetries      int
+	DbBusyRetryDelayMs int
+	RecordRetries      int
+	RecordRetryDelayMs int
+
+	StartupRetries           int
+	StartupRetryDelaySeconds int
+	DedupSelectSql           string
+	DedupInsertSql           string
+
+	DedupBackend   string
+	RedisAddress   string
+	RedisPassword  string
+	RedisDB        int
+	RedisKeyPrefix string
+
+	LogLevel            string
+	LogFilePath         string
+	LogFileMaxSizeMB    int
+	LogFileMaxBackups   int
+	LogFileMaxAgeDays   int
+	LogFileEcho         bool
+	AuditLogPath        string
+	StatusListenAddress string
+	OTLPEndpoint        string
+
+	OnFailureCommand               []string
+	OnFailureCommandTimeoutSeconds int
+	OnUploadWebhook                string
+
+	MaxUploadAttempts          int
+	DeadLetterDir              string
+	FailedRetryIntervalSeconds int
+	ContinueOnError            bool
+
+	AfterUpload string
+
+	ArchiveDir            string
+	ArchiveMinFreeMB      int
+	MoveCollisionStrategy string
+
+	S3Endpoint           string
+	S3Region             string
+	S3Bucket             string
+	S3AccessKeyID        string
+	S3SecretAccessKey    string
+	S3KeyPrefix          string
+	S3DatePrefix         bool
+	S3DeleteAfterArchive bool
+	S3TimeoutSeconds     int
+
+	excludeRegexp          *regexp.Regexp
+	filenameMetadataRegexp *regexp.Regexp
+	slackFilenameRegexp    *regexp.Regexp
+	digestTime             time.Time
+	fileDateLocation       *time.Location
+}
+
+// readConfig reads and validates the configuration at confFilePath. Any error is a *ConfigError.
+func readConfig(confFilePath string) (*Config, error) {
+	conf, err := parseConfig(confFilePath)
+	if err != nil {
+		return nil, &ConfigError{err}
+	}
+
+	return conf, nil
+}
+
+func parseConfig(confFilePath string) (*Config, error) {
+	if confBytes, err := ioutil.ReadFile(confFilePath); err != nil {
+		return nil, err
+	} else {
+		conf := &Config{
+			ReplayGlob:                     REPLAY_GLOB,
+			DatabasePath:                   DB_PATH,
+			CheckIntervalSeconds:           CHECK_INTERVAL_SECONDS,
+			ScanOnStartup:                  true,
+			ContinueOnError:                true,
+			Target:                         TARGET_SLACK,
+			SlackApiBaseUrl:                DEFAULT_SLACK_API_BASE_URL,
+			UploadMethod:                   UPLOAD_METHOD_FILES_UPLOAD,
+			MissingDirectoryPolicy:         MISSING_DIRECTORY_WAIT,
+			MoveCollisionStrategy:          MOVE_COLLISION_RENAME,
+			UploadOrder:                    UPLOAD_ORDER_MTIME,
+			DebounceSeconds:                DEFAULT_DEBOUNCE_SECONDS,
+			SettleMode:                     SETTLE_MODE_MTIME,
+			LogLevel:                       LOG_LEVEL_INFO,
+			LogFileMaxSizeMB:               DEFAULT_LOG_FILE_MAX_SIZE_MB,
+			LogFileMaxBackups:              DEFAULT_LOG_FILE_MAX_BACKUPS,
+			LogFileEcho:                    true,
+			DbMaxOpenConns:                 DEFAULT_DB_MAX_OPEN_CONNS,
+			DbBusyTimeoutMs:                DEFAULT_DB_BUSY_TIMEOUT_MS,
+			DbBusyRetries:                  DEFAULT_DB_BUSY_RETRIES,
+			DbBusyRetryDelayMs:             DEFAULT_DB_BUSY_RETRY_DELAY_MS,
+			RecordRetries:                  DEFAULT_RECORD_RETRIES,
+			RecordRetryDelayMs:             DEFAULT_RECORD_RETRY_DELAY_MS,
+			StartupRetryDelaySeconds:       DEFAULT_STARTUP_RETRY_DELAY_SECONDS,
+			ProgressLogThresholdBytes:      DEFAULT_PROGRESS_LOG_THRESHOLD_BYTES,
+			DedupBackend:                   DEDUP_BACKEND_SQLITE,
+			RedisKeyPrefix:                 DEFAULT_REDIS_KEY_PREFIX,
+			MessageFormat:                  MESSAGE_FORMAT_FILE,
+			TempDir:                        os.TempDir(),
+			OpsAlertFailureStreak:          DEFAULT_OPS_ALERT_FAILURE_STREAK,
+			OpsAlertMinIntervalSeconds:     DEFAULT_OPS_ALERT_MIN_INTERVAL_SECONDS,
+			BlocksTemplate:                 DEFAULT_BLOCKS_TEMPLATE,
+			FileDateLayout:                 DEFAULT_FILE_DATE_LAYOUT,
+			S3TimeoutSeconds:               DEFAULT_S3_TIMEOUT_SECONDS,
+			UploadHttpMethod:               http.MethodPost,
+			OnFailureCommandTimeoutSeconds: DEFAULT_FAILURE_COMMAND_TIMEOUT_SECONDS,
+			TempFileSuffixes:               []string{".tmp", ".part"},
+		}
+		err = json.Unmarshal(confBytes, conf)
+
+		if err != nil {
+			return nil, err
+		}
+
+		expandConfigEnv(conf)
+
+		if conf.ExcludePattern != "" {
+			if conf.excludeRegexp, err = regexp.Compile(conf.ExcludePattern); err != nil {
+				return nil, errors.New(fmt.Sprintf("Invalid ExcludePattern '%s': %s", conf.ExcludePattern, err))
+			}
+		}
+
+		if conf.FileDateTimeZone != "" {
+			if conf.fileDateLocation, err = time.LoadLocation(conf.FileDateTimeZone); err != nil {
+				return nil, errors.New(fmt.Sprintf("Invalid FileDateTimeZone '%s': %s", conf.FileDateTimeZone, err))
+			}
+		}
+
+		if conf.SlackFilenamePattern != "" {
+			if conf.SlackFilenameTemplate != "" {
+				return nil, errors.New("Only one of SlackFilenameTemplate and SlackFilenamePattern may be set")
+			}
+			if conf.slackFilenameRegexp, err = regexp.Compile(conf.SlackFilenamePattern); err != nil {
+				return nil, errors.New(fmt.Sprintf("Invalid SlackFilenamePattern '%s': %s", conf.SlackFilenamePattern, err))
+			}
+		}
+
+		if conf.AuthTokenFile != "" {
+			if tokenBytes, err := ioutil.ReadFile(conf.AuthTokenFile); err != nil {
+				return nil, errors.New(fmt.Sprintf("Error reading AuthTokenFile '%s': %s", conf.AuthTokenFile, err))
+			} else if token := strings.TrimSpace(string(tokenBytes)); token == "" {
+				return nil, errors.New(fmt.Sprintf("AuthTokenFile '%s' is empty", conf.AuthTokenFile))
+			} else {
+				conf.AuthToken = token
+			}
+		}
+
+		if _, err := filepath.Match(conf.ReplayGlob, ""); err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid ReplayGlob '%s': %s", conf.ReplayGlob, err))
+		}
+
+		if conf.CheckIntervalSeconds <= 0 {
+			return nil, errors.New(fmt.Sprintf("Invalid CheckIntervalSeconds %d: must be positive", conf.CheckIntervalSeconds))
+		}
+
+		if conf.CheckIntervalJitterPercent < 0 || conf.CheckIntervalJitterPercent > 100 {
+			return nil, errors.New(fmt.Sprintf("Invalid CheckIntervalJitterPercent %d: must be between 0 and 100", conf.CheckIntervalJitterPercent))
+		}
+
+		if conf.ScanTimeoutSeconds < 0 {
+			return nil, errors.New(fmt.Sprintf("Invalid ScanTimeoutSeconds %d: must not be negative", conf.ScanTimeoutSeconds))
+		}
+
+		if conf.CheckIntervalJitterSeconds < 0 || conf.CheckIntervalJitterSeconds > conf.CheckIntervalSeconds {
+			return nil, errors.New(fmt.Sprintf("Invalid CheckIntervalJitterSeconds %d: must be between 0 and CheckIntervalSeconds", conf.CheckIntervalJitterSeconds))
+		}
+		if conf.CheckIntervalJitterSeconds > 0 && conf.CheckIntervalJitterPercent > 0 {
+			return nil, errors.New("Only one of CheckIntervalJitterSeconds and CheckIntervalJitterPercent may be set")
+		}
+
+		if baseUrl, err := url.Parse(conf.SlackApiBaseUrl); err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid SlackApiBaseUrl '%s': %s", conf.SlackApiBaseUrl, err))
+		} else if (baseUrl.Scheme != "http" && baseUrl.Scheme != "https") || baseUrl.Host == "" {
+			return nil, errors.New(fmt.Sprintf("Invalid SlackApiBaseUrl '%s': must be an absolute http(s) URL", conf.SlackApiBaseUrl))
+		}
+
+		for _, suffix := range conf.TempFileSuffixes {
+			if suffix == "" {
+				return nil, errors.New("Invalid TempFileSuffixes: suffixes must not be empty")
+			}
+		}
+
+		for field, name := range conf.MultipartFieldNames {
+			known := false
+			for _, multipartField := range MULTIPART_FIELDS {
+				known = known || field == multipartField
+			}
+
+			if !known {
+				return nil, errors.New(fmt.Sprintf("Invalid MultipartFieldNames field '%s': must be one of %s", field, strings.Join(MULTIPART_FIELDS, ", ")))
+			} else if name == "" {
+				return nil, errors.New(fmt.Sprintf("Invalid MultipartFieldNames name for field '%s': must not be empty", field))
+			}
+		}
+
+		for name := range conf.ExtraFormFields {
+			reserved := name == ""
+			for _, field := range RESERVED_FORM_FIELDS {
+				reserved = reserved || name == field || name == multipartFieldName(field, conf)
+			}
+
+			if reserved {
+				return nil, errors.New(fmt.Sprintf("Invalid ExtraFormFields field '%s': must not be empty or one of %s", name, strings.Join(RESERVED_FORM_FIELDS, ", ")))
+			}
+		}
+
+		if conf.UploadHttpMethod != http.MethodPost && conf.UploadHttpMethod != http.MethodPut {
+			return nil, errors.New(fmt.Sprintf("Invalid UploadHttpMethod '%s': must be '%s' or '%s'", conf.UploadHttpMethod, http.MethodPost, http.MethodPut))
+		}
+
+		// configurations predating AfterUpload archived to S3 whenever a bucket was set
+		if conf.AfterUpload == AFTER_UPLOAD_NONE && conf.S3Bucket != "" {
+			conf.AfterUpload = AFTER_UPLOAD_S3
+		}
+
+		if conf.AfterUpload != AFTER_UPLOAD_NONE && conf.AfterUpload != AFTER_UPLOAD_S3 && conf.AfterUpload != AFTER_UPLOAD_MOVE {
+			return nil, errors.New(fmt.Sprintf("Invalid AfterUpload '%s': must be '%s', '%s' or empty", conf.AfterUpload, AFTER_UPLOAD_S3, AFTER_UPLOAD_MOVE))
+		}
+
+		if info, err := os.Stat(conf.TempDir); err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid TempDir '%s': %s", conf.TempDir, err))
+		} else if !info.IsDir() {
+			return nil, errors.New(fmt.Sprintf("Invalid TempDir '%s': not a directory", conf.TempDir))
+		}
+
+		if conf.AfterUpload == AFTER_UPLOAD_MOVE && conf.ArchiveDir == "" {
+			return nil, errors.New(fmt.Sprintf("AfterUpload '%s' requires ArchiveDir to be set", AFTER_UPLOAD_MOVE))
+		}
+
+		if conf.AttachThumbnail && (conf.Target != TARGET_SLACK || conf.UploadMethod != UPLOAD_METHOD_FILES_UPLOAD) {
+			return nil, errors.New(fmt.Sprintf("AttachThumbnail only works with Target '%s' and UploadMethod '%s', the preview would be dropped otherwise",
+				TARGET_SLACK, UPLOAD_METHOD_FILES_UPLOAD))
+		}
+
+		if conf.IncludeChecksumInTitle && conf.OptimizeGifs {
+			return nil, errors.New("IncludeChecksumInTitle can't be combined with OptimizeGifs, since the posted file wouldn't match the replay's checksum")
+		}
+
+		if conf.MoveCollisionStrategy != MOVE_COLLISION_RENAME && conf.MoveCollisionStrategy != MOVE_COLLISION_SKIP && conf.MoveCollisionStrategy != MOVE_COLLISION_OVERWRITE {
+			return nil, errors.New(fmt.Sprintf("Invalid MoveCollisionStrategy '%s': must be '%s', '%s' or '%s'", conf.MoveCollisionStrategy,
+				MOVE_COLLISION_RENAME, MOVE_COLLISION_SKIP, MOVE_COLLISION_OVERWRITE))
+		}
+
+		if conf.S3TimeoutSeconds <= 0 {
+			return nil, errors.New(fmt.Sprintf("Invalid S3TimeoutSeconds %d: must be positive", conf.S3TimeoutSeconds))
+		}
+
+		if conf.OnFailureCommandTimeoutSeconds <= 0 {
+			return nil, errors.New(fmt.Sprintf("Invalid OnFailureCommandTimeoutSeconds %d: must be positive", conf.OnFailureCommandTimeoutSeconds))
+		}
+
+		if conf.AfterUpload == AFTER_UPLOAD_S3 && conf.S3Bucket == "" {
+			return nil, errors.New(fmt.Sprintf("AfterUpload '%s' requires S3Bucket to be set", AFTER_UPLOAD_S3))
+		}
+
+		if conf.Target != TARGET_SLACK && conf.Target != TARGET_MATTERMOST {
+			return nil, errors.New(fmt.Sprintf("Invalid Target '%s': must be '%s' or '%s'", conf.Target, TARGET_SLACK, TARGET_MATTERMOST))
+		}
+
+		if conf.Target == TARGET_MATTERMOST && (conf.MattermostURL == "" || conf.MattermostToken == "") {
+			return nil, errors.New(fmt.Sprintf("Target '%s' requires MattermostURL and MattermostToken to be set", TARGET_MATTERMOST))
+		}
+
+		if conf.MessageFormat != MESSAGE_FORMAT_FILE && conf.MessageFormat != MESSAGE_FORMAT_BLOCKS {
+			return nil, errors.New(fmt.Sprintf("Invalid MessageFormat '%s': must be '%s' or '%s'", conf.MessageFormat, MESSAGE_FORMAT_FILE, MESSAGE_FORMAT_BLOCKS))
+		}
+		if conf.MessageFormat == MESSAGE_FORMAT_BLOCKS {
+			if conf.Target != TARGET_SLACK {
+				return nil, errors.New(fmt.Sprintf("MessageFormat '%s' is only supported with Target '%s'", MESSAGE_FORMAT_BLOCKS, TARGET_SLACK))
+			}
+			if err := validateBlocksTemplate(conf.BlocksTemplate); err != nil {
+				return nil, err
+			}
+		}
+
+		if conf.OpsChannelID != "" && conf.Target != TARGET_SLACK {
+			return nil, errors.New(fmt.Sprintf("OpsChannelID is only supported with Target '%s'", TARGET_SLACK))
+		}
+
+		if conf.BatchUpload && (conf.Target != TARGET_SLACK || conf.UploadMethod != UPLOAD_METHOD_EXTERNAL || conf.MessageFormat != MESSAGE_FORMAT_FILE) {
+			return nil, errors.New(fmt.Sprintf("BatchUpload requires Target '%s', UploadMethod '%s' and MessageFormat '%s'", TARGET_SLACK, UPLOAD_METHOD_EXTERNAL, MESSAGE_FORMAT_FILE))
+		}
+
+		if conf.UploadMethod != UPLOAD_METHOD_FILES_UPLOAD && conf.UploadMethod != UPLOAD_METHOD_EXTERNAL {
+			return nil, errors.New(fmt.Sprintf("Invalid UploadMethod '%s': must be '%s' or '%s'", conf.UploadMethod, UPLOAD_METHOD_FILES_UPLOAD, UPLOAD_METHOD_EXTERNAL))
+		}
+
+		if conf.ExternalUploadChunkBytes < 0 {
+			return nil, errors.New(fmt.Sprintf("Invalid ExternalUploadChunkBytes %d: must not be negative", conf.ExternalUploadChunkBytes))
+		}
+
+		// MaxUploadsPerMinute is the older name of UploadsPerMinute
+		if conf.UploadsPerMinute == 0 {
+			conf.UploadsPerMinute = conf.MaxUploadsPerMinute
+		}
+
+		if conf.SettleMode != SETTLE_MODE_MTIME && conf.SettleMode != SETTLE_MODE_SIZE {
+			return nil, errors.New(fmt.Sprintf("Invalid SettleMode '%s': must be '%s' or '%s'", conf.SettleMode, SETTLE_MODE_MTIME, SETTLE_MODE_SIZE))
+		}
+
+		if conf.UploadOrder != UPLOAD_ORDER_NAME && conf.UploadOrder != UPLOAD_ORDER_MTIME {
+			return nil, errors.New(fmt.Sprintf("Invalid UploadOrder '%s': must be '%s' or '%s'", conf.UploadOrder, UPLOAD_ORDER_NAME, UPLOAD_ORDER_MTIME))
+		}
+
+		if conf.DigestTime != "" {
+			if conf.digestTime, err = time.Parse("15:04", conf.DigestTime); err != nil {
+				return nil, errors.New(fmt.Sprintf("Invalid DigestTime '%s': must be a 24-hour time like '20:00'", conf.DigestTime))
+			}
+		}
+
+		if (conf.BundleThread || conf.DigestMode) && strings.Contains(conf.ChannelID, ",") {
+			return nil, errors.New(fmt.Sprintf("Invalid ChannelID '%s': BundleThread and DigestMode post replies in a thread, which needs exactly one channel", conf.ChannelID))
+		}
+
+		if conf.DigestMode && conf.DigestTime == "" && conf.DigestIdleMinutes <= 0 {
+			return nil, errors.New("DigestMode requires DigestTime or DigestIdleMinutes to be set")
+		}
+
+		if conf.DedupSelectSql != "" && strings.Count(conf.DedupSelectSql, "?") != 1 {
+			return nil, errors.New(fmt.Sprintf("Invalid DedupSelectSql '%s': must have exactly one '?' placeholder", conf.DedupSelectSql))
+		}
+		if conf.DedupInsertSql != "" && strings.Count(conf.DedupInsertSql, "?") != 1 {
+			return nil, errors.New(fmt.Sprintf("Invalid DedupInsertSql '%s': must have exactly one '?' placeholder", conf.DedupInsertSql))
+		}
+
+		if conf.DedupBackend != DEDUP_BACKEND_SQLITE && conf.DedupBackend != DEDUP_BACKEND_REDIS {
+			return nil, errors.New(fmt.Sprintf("Invalid DedupBackend '%s': must be '%s' or '%s'", conf.DedupBackend, DEDUP_BACKEND_SQLITE, DEDUP_BACKEND_REDIS))
+		}
+		if conf.DedupBackend == DEDUP_BACKEND_REDIS && conf.RedisAddress == "" {
+			return nil, errors.New(fmt.Sprintf("DedupBackend '%s' requires RedisAddress to be set", DEDUP_BACKEND_REDIS))
+		}
+
+		if logLevelIndex(conf.LogLevel) < 0 {
+			return nil, errors.New(fmt.Sprintf("Invalid LogLevel '%s': must be one of %s", conf.LogLevel, strings.Join(LOG_LEVELS, ", ")))
+		}
+
+		if conf.RecordRetries < 0 || conf.RecordRetryDelayMs < 0 {
+			return nil, errors.New("RecordRetries and RecordRetryDelayMs must not be negative")
+		}
+
+		if conf.StartupRetries < 0 || conf.StartupRetryDelaySeconds < 0 {
+			return nil, errors.New("StartupRetries and StartupRetryDelaySeconds must not be negative")
+		}
+
+		if conf.MaxConnsPerHost < 0 || conf.MaxIdleConnsPerHost < 0 || conf.MaxConcurrentRequests < 0 {
+			return nil, errors.New("MaxConnsPerHost, MaxIdleConnsPerHost and MaxConcurrentRequests must not be negative")
+		}
+
+		if conf.LogFileMaxSizeMB <= 0 {
+			return nil, errors.New(fmt.Sprintf("Invalid LogFileMaxSizeMB %d: must be positive", conf.LogFileMaxSizeMB))
+		}
+		if conf.LogFileMaxBackups < 0 || conf.LogFileMaxAgeDays < 0 {
+			return nil, errors.New("LogFileMaxBackups and LogFileMaxAgeDays must not be negative")
+		}
+
+		if conf.MissingDirectoryPolicy != MISSING_DIRECTORY_WAIT && conf.MissingDirectoryPolicy != MISSING_DIRECTORY_EXIT {
+			return nil, errors.New(fmt.Sprintf("Invalid MissingDirectoryPolicy '%s': must be '%s' or '%s'", conf.MissingDirectoryPolicy, MISSING_DIRECTORY_WAIT, MISSING_DIRECTORY_EXIT))
+		}
+
+		if conf.FilenameMetadataPattern != "" {
+			if conf.filenameMetadataRegexp, err = regexp.Compile(conf.FilenameMetadataPattern); err != nil {
+				return nil, errors.New(fmt.Sprintf("Invalid FilenameMetadataPattern '%s': %s", conf.FilenameMetadataPattern, err))
+			}
+		}
+
+		return conf, nil
+	}
+}
+
+// expandConfigEnv expands $VAR and ${VAR} in the config's path and address fields. Secrets, patterns
+// and templates are left alone, since a '$' in them is far more likely to be meant literally.
+func expandConfigEnv(conf *Config) {
+	for _, field := range []*string{&conf.ReplayDirectoryPath, &conf.DatabasePath, &conf.AuthTokenFile, &conf.DeadLetterDir, &conf.ArchiveDir, &conf.AuditLogPath, &conf.LogFilePath, &conf.TempDir,
+		&conf.SlackApiBaseUrl, &conf.MattermostURL, &conf.OnUploadWebhook, &conf.StatusListenAddress, &conf.OTLPEndpoint, &conf.RedisAddress,
+		&conf.S3Endpoint, &conf.S3Bucket, &conf.S3KeyPrefix} {
+		*field = os.ExpandEnv(*field)
+	}
 }
 
 func fileExists(filePath string) bool {
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const TRACING_SERVICE_NAME string = "towerfall_replay_slack_uploader"
+const TRACING_EXPORT_QUEUE_SIZE int = 256
+const TRACING_EXPORT_TIMEOUT_SECONDS time.Duration = time.Duration(10)
+
+const SPAN_KIND_INTERNAL int = 1
+const SPAN_KIND_CLIENT int = 3
+
+const SPAN_STATUS_OK int = 1
+const SPAN_STATUS_ERROR int = 2
+
+// tracer exports spans to an OpenTelemetry collector over OTLP/HTTP. It is nil unless OTLPEndpoint is
+// configured, in which case every Span is nil too and all span operations are no-ops.
+var tracer *Tracer
+
+type Tracer struct {
+	endpoint string
+	client   *http.Client
+	spans    chan map[string]interface{}
+}
+
+type Span struct {
+	traceId      string
+	spanId       string
+	parentSpanId string
+	name         string
+	kind         int
+	start        time.Time
+	attributes   map[string]interface{}
+}
+
+type spanContextKey struct{}
+
+// startTracing starts exporting spans to the collector at endpoint (e.g. "http://localhost:4318").
+func startTracing(endpoint string) {
+	tracer = &Tracer{
+		endpoint: strings.TrimRight(endpoint, "/") + "/v1/traces",
+		client:   &http.Client{Timeout: TRACING_EXPORT_TIMEOUT_SECONDS * time.Second},
+		spans:    make(chan map[string]interface{}, TRACING_EXPORT_QUEUE_SIZE),
+	}
+	go tracer.export()
+}
+
+// startSpan starts a span as a child of the span in ctx, if any, and returns a context carrying it.
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	if tracer == nil {
+		return ctx, nil
+	}
+
+	span := &Span{spanId: randomHex(8), name: name, kind: kind, start: time.Now(), attributes: make(map[string]interface{})}
+	if parent, ok := ctx.Value(spanContextKey{}).(*Span); ok {
+		span.traceId = parent.traceId
+		span.parentSpanId = parent.spanId
+	} else {
+		span.traceId = randomHex(16)
+	}
+
+	return context.WithValue(ctx, spanContextKey{}, span), span
+}
+
+func (s *Span) setAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+
+	s.attributes[key] = value
+}
+
+// end finishes the span, marking it as failed if err is non-nil, and queues it for export. Spans are
+// dropped rather than blocking when the collector can't keep up.
+func (s *Span) end(err error) {
+	if s == nil {
+		return
+	}
+
+	status := map[string]interface{}{"code": SPAN_STATUS_OK}
+	if err != nil {
+		status = map[string]interface{}{"code": SPAN_STATUS_ERROR, "message": err.Error()}
+	}
+
+	attributes := make([]map[string]interface{}, 0, len(s.attributes))
+	for key, value := range s.attributes {
+		attributes = append(attributes, map[string]interface{}{"key": key, "value": otlpValue(value)})
+	}
+
+	exported := map[string]interface{}{
+		"traceId":           s.traceId,
+		"spanId":            s.spanId,
+		"parentSpanId":      s.parentSpanId,
+		"name":              s.name,
+		"kind":              s.kind,
+		"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(time.Now().UnixNano(), 10),
+		"attributes":        attributes,
+		"status":            status,
+	}
+
+	select {
+	case tracer.spans <- exported:
+	default:
+		logWarnf("Dropping trace span '%s': export queue is full", s.name)
+	}
+}
+
+func (t *Tracer) export() {
+	for span := range t.spans {
+		spanName := span["name"]
+		payload, err := json.Marshal(map[string]interface{}{
+			"resourceSpans": []interface{}{map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": []interface{}{map[string]interface{}{"key": "service.name", "value": otlpValue(TRACING_SERVICE_NAME)}},
+				},
+				"scopeSpans": []interface{}{map[string]interface{}{
+					"scope": map[string]interface{}{"name": TRACING_SERVICE_NAME},
+					"spans": []interface{}{span},
+				}},
+			}},
+		})
+		if err != nil {
+			logErrorf("Error encoding trace span '%s': %s", spanName, err)
+			continue
+		}
+
+		resp, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(payload))
+		if err != nil {
+			logErrorf("Error exporting trace span '%s': %s", spanName, err)
+			continue
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			logErrorf("Error exporting trace span '%s': %d", spanName, resp.StatusCode)
+		}
+	}
+}
+
+func otlpValue(value interface{}) map[string]interface{} {
+	switch typed := value.(type) {
+	case int:
+		return map[string]interface{}{"intValue": strconv.Itoa(typed)}
+	case int64:
+		return map[string]interface{}{"intValue": strconv.FormatInt(typed, 10)}
+	case bool:
+		return map[string]interface{}{"boolValue": typed}
+	default:
+		return map[string]interface{}{"stringValue": fmt.Sprint(typed)}
+	}
+}
+
+func randomHex(numBytes int) string {
+	randomBytes := make([]byte, numBytes)
+	rand.Read(randomBytes)
+	return hex.EncodeToString(randomBytes)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+const DEFAULT_PROGRESS_LOG_THRESHOLD_BYTES int = 10 * 1024 * 1024
+const PROGRESS_LOG_INTERVAL_SECONDS int = 5
+
+// ProgressReader logs how much of a replay has been read at most every PROGRESS_LOG_INTERVAL_SECONDS,
+// so that a large upload can be told apart from a hung one.
+type ProgressReader struct {
+	reader         io.Reader
+	replayFilePath string
+	totalBytes     int64
+	readBytes      int64
+	lastLogged     time.Time
+}
+
+// newProgressReader wraps a replay's reader in a ProgressReader if the replay is at least
+// ProgressLogThresholdBytes in size, and returns it unwrapped otherwise.
+func newProgressReader(reader io.Reader, totalBytes int64, replayFilePath string, config *Config) io.Reader {
+	if config.ProgressLogThresholdBytes <= 0 || totalBytes < int64(config.ProgressLogThresholdBytes) {
+		return reader
+	}
+
+	return &ProgressReader{reader: reader, replayFilePath: replayFilePath, totalBytes: totalBytes, lastLogged: time.Now()}
+}
+
+func (r *ProgressReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.readBytes += int64(n)
+
+	if time.Since(r.lastLogged) >= time.Duration(PROGRESS_LOG_INTERVAL_SECONDS)*time.Second {
+		logInfof("Uploaded %d of %d bytes (%d%%) of replay '%s'", r.readBytes, r.totalBytes, r.readBytes*100/r.totalBytes, r.replayFilePath)
+		r.lastLogged = time.Now()
+	}
+
+	return n, err
+}
+
+// The bytes sent in upload request bodies since the uploader started, served as a counter on /metrics.
+var uploadedBytesTotal int64
+
+// CountingReader counts the bytes read through it, so that an upload's throughput can be worked out
+// once it's done.
+type CountingReader struct {
+	reader    io.Reader
+	readBytes int64
+}
+
+func (r *CountingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.readBytes += int64(n)
+	atomic.AddInt64(&uploadedBytesTotal, int64(n))
+
+	return n, err
+}
+
+// formatThroughput describes how fast byteCount bytes were sent in elapsed, e.g.
+// "4.2 MB in 3.1s, 1.35 MB/s".
+func formatThroughput(byteCount int64, elapsed time.Duration) string {
+	megabytes := float64(byteCount) / 1e6
+	seconds := elapsed.Seconds()
+	if seconds <= 0 {
+		return fmt.Sprintf("%.1f MB in %.1fs", megabytes, seconds)
+	}
+
+	return fmt.Sprintf("%.1f MB in %.1fs, %.2f MB/s", megabytes, seconds, megabytes/seconds)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// The upload queue records every replay that has been discovered but not yet uploaded, so that a
+// restart picks up where it left off and failing replays can be inspected with plain SQL, e.g.
+//
+//	SELECT * FROM upload_queue WHERE status != 'done';
+const CREATE_UPLOAD_QUEUE_SQL string = `CREATE TABLE IF NOT EXISTS upload_queue(
+	replay_file_name varchar(512) PRIMARY KEY,
+	status varchar(16) NOT NULL,
+	attempts integer NOT NULL DEFAULT 0,
+	last_error text,
+	discovered_at integer NOT NULL,
+	updated_at integer NOT NULL
+);`
+
+const QUEUE_STATUS_PENDING string = "pending"
+const QUEUE_STATUS_FAILED string = "failed"
+const QUEUE_STATUS_DONE string = "done"
+const QUEUE_STATUS_DEAD_LETTERED string = "dead_lettered"
+const QUEUE_STATUS_DENIED string = "denied"
+
+func enqueueReplay(replayFileName string, db *sql.DB) error {
+	now := time.Now().Unix()
+	_, err := db.Exec("INSERT OR IGNORE INTO upload_queue(replay_file_name, status, discovered_at, updated_at) VALUES(?, ?, ?, ?);",
+		replayFileName, QUEUE_STATUS_PENDING, now, now)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Error queueing replay '%s': %s", replayFileName, err))
+	}
+
+	return nil
+}
+
+func markReplayFailed(replayFileName string, uploadErr error, db *sql.DB) error {
+	_, err := db.Exec("UPDATE upload_queue SET status = ?, attempts = attempts + 1, last_error = ?, updated_at = ? WHERE replay_file_name = ?;",
+		QUEUE_STATUS_FAILED, uploadErr.Error(), time.Now().Unix(), replayFileName)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Error recording that replay '%s' failed to upload: %s", replayFileName, err))
+	}
+
+	return nil
+}
+
+func markReplayDone(replayFileName string, db *sql.DB) error {
+	_, err := db.Exec("UPDATE upload_queue SET status = ?, attempts = attempts + 1, last_error = NULL, updated_at = ? WHERE replay_file_name = ?;",
+		QUEUE_STATUS_DONE, time.Now().Unix(), replayFileName)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Error dequeueing replay '%s': %s", replayFileName, err))
+	}
+
+	return nil
+}
+
+func markReplayDeadLettered(replayFileName string, db *sql.DB) error {
+	_, err := db.Exec("UPDATE upload_queue SET status = ?, updated_at = ? WHERE replay_file_name = ?;",
+		QUEUE_STATUS_DEAD_LETTERED, time.Now().Unix(), replayFileName)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Error recording that replay '%s' was dead-lettered: %s", replayFileName, err))
+	}
+
+	return nil
+}
+
+// markReplayPending puts a replay back in the queue as if it had just been discovered.
+func markReplayPending(replayFileName string, db *sql.DB) error {
+	_, err := db.Exec("UPDATE upload_queue SET status = ?, attempts = 0, last_error = NULL, updated_at = ? WHERE replay_file_name = ?;",
+		QUEUE_STATUS_PENDING, time.Now().Unix(), replayFileName)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Error requeueing replay '%s': %s", replayFileName, err))
+	}
+
+	return nil
+}
+
+// markReplayDenied records that a replay must never be uploaded, even once it's no longer listed in
+// DenyFilenames.
+func markReplayDenied(replayFileName string, db *sql.DB) error {
+	if err := enqueueReplay(replayFileName, db); err != nil {
+		return err
+	}
+
+	_, err := db.Exec("UPDATE upload_queue SET status = ?, updated_at = ? WHERE replay_file_name = ?;",
+		QUEUE_STATUS_DENIED, time.Now().Unix(), replayFileName)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Error recording that replay '%s' was denied: %s", replayFileName, err))
+	}
+
+	return nil
+}
+
+// replayQueueStatus returns a replay's status in the upload queue, or "" if it was never queued.
+func replayQueueStatus(replayFileName string, db *sql.DB) (string, error) {
+	var status string
+	err := db.QueryRow("SELECT status FROM upload_queue WHERE replay_file_name = ?;", replayFileName).Scan(&status)
+	if err == sql.ErrNoRows {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	return status, nil
+}
+
+// failedReplayNames returns the replays that failed to upload or were dead-lettered, oldest first.
+func failedReplayNames(db *sql.DB) ([]string, error) {
+	rows, err := db.Query("SELECT replay_file_name FROM upload_queue WHERE status IN (?, ?) ORDER BY updated_at, replay_file_name;",
+		QUEUE_STATUS_FAILED, QUEUE_STATUS_DEAD_LETTERED)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	replayNames := make([]string, 0)
+	for rows.Next() {
+		var replayName string
+		if err := rows.Scan(&replayName); err != nil {
+			return nil, err
+		}
+		replayNames = append(replayNames, replayName)
+	}
+
+	return replayNames, rows.Err()
+}
+
+func replayUploadAttempts(replayFileName string, db *sql.DB) (int, error) {
+	var attempts int
+	err := db.QueryRow("SELECT attempts FROM upload_queue WHERE replay_file_name = ?;", replayFileName).Scan(&attempts)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	return attempts, nil
+}
+
+// dequeueReplay forgets a replay that was queued but is no longer there to upload.
+func dequeueReplay(replayFileName string, db *sql.DB) error {
+	if _, err := db.Exec("DELETE FROM upload_queue WHERE replay_file_name = ?;", replayFileName); err != nil {
+		return errors.New(fmt.Sprintf("Error removing replay '%s' from the upload queue: %s", replayFileName, err))
+	}
+
+	return nil
+}
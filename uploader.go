@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+)
+
+const TARGET_SLACK string = "slack"
+const TARGET_MATTERMOST string = "mattermost"
+
+// UploadResult is what a target reports back about an uploaded replay: the id the file was stored
+// under, and the id of the message it was shared in, which later replays can be threaded under.
+type UploadResult struct {
+	FileId   string
+	ThreadId string
+}
+
+// Uploader posts a prepared replay to the configured chat target. Everything before the upload itself,
+// from the watch loop to the dedup database, is shared between targets.
+type Uploader interface {
+	upload(ctx context.Context, upload *ReplayUpload, db *sql.DB, config *Config) (*UploadResult, error)
+}
+
+func newUploader(config *Config) Uploader {
+	if config.Target == TARGET_MATTERMOST {
+		return &MattermostUploader{}
+	}
+
+	return &SlackUploader{}
+}
+
+// SlackUploader uploads replays to Slack with the configured UploadMethod, and posts them in a Block Kit
+// message when MessageFormat is "blocks". With AutoJoinChannel, an upload refused because the uploader
+// isn't in the channel is retried once after joining it.
+type SlackUploader struct{}
+
+func (u *SlackUploader) upload(ctx context.Context, upload *ReplayUpload, db *sql.DB, config *Config) (*UploadResult, error) {
+	var result *UploadResult
+	err := retryAfterJoiningChannel(ctx, config, func() (err error) {
+		result, err = u.post(ctx, upload, db, config)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (u *SlackUploader) post(ctx context.Context, upload *ReplayUpload, db *sql.DB, config *Config) (*UploadResult, error) {
+	var responseBody *ResponseBody
+	var err error
+	if config.UploadMethod == UPLOAD_METHOD_EXTERNAL {
+		responseBody, err = uploadReplayExternal(ctx, upload, db, config)
+	} else {
+		responseBody, err = uploadReplay(ctx, upload, config)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if config.MessageFormat == MESSAGE_FORMAT_BLOCKS {
+		ts, err := postReplayBlocks(ctx, upload, responseBody.File, config)
+		if err != nil {
+			return nil, err
+		}
+		return &UploadResult{FileId: responseBody.File.Id, ThreadId: ts}, nil
+	}
+
+	return &UploadResult{FileId: responseBody.File.Id, ThreadId: responseBody.shareTs(config.ChannelID)}, nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// version, commit and date describe the build, and are set at build time, e.g.
+//
+//	go build -ldflags "-X main.version=1.2.0 -X main.commit=$(git rev-parse --short HEAD) -X main.date=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var version string = "dev"
+var commit string = "unknown"
+var date string = "unknown"
+
+// versionString describes the build, e.g. "1.2.0 (commit 9c04c36, built 2024-01-15T20:00:00Z)".
+func versionString() string {
+	return fmt.Sprintf("%s (commit %s, built %s)", version, commit, date)
+}
+
+func userAgent() string {
+	return "towerfall-replay-uploader/" + version
+}
+
+// UserAgentTransport sets the uploader's User-Agent on every request it sends, so that Slack can tell
+// its traffic apart.
+type UserAgentTransport struct {
+	base http.RoundTripper
+}
+
+func (t *UserAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("User-Agent") == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("User-Agent", userAgent())
+	}
+
+	return t.base.RoundTrip(req)
+}
+
+// httpClient sends every request to Slack and Mattermost.
+var httpClient = &http.Client{Transport: &UserAgentTransport{base: http.DefaultTransport}}